@@ -3,17 +3,51 @@ package main
 import (
 	"os"
 
-	flexvol "github.com/rancher/rancher-flexvol"
+	"github.com/Sirupsen/logrus"
 	"github.com/rancher/secrets-flexvol/secrets"
+	"github.com/urfave/cli"
 )
 
 var VERSION = "v0.0.0-dev"
 
 func main() {
-	backend := &secrets.FlexVolume{}
+	backend, err := secrets.NewFlexVolume()
+	if err != nil {
+		logrus.Fatal(err)
+	}
 
-	app := flexvol.NewApp(backend)
+	app := secrets.NewApp(secrets.NewDaemonClient(backend))
 	app.Version = VERSION
+	app.Flags = append(secrets.LoggingFlags(), secrets.AuditFlags()...)
+	app.Flags = append(app.Flags, secrets.MetricsFlags()...)
+	app.Flags = append(app.Flags, secrets.TracingFlags()...)
+	app.Flags = append(app.Flags, secrets.DaemonFlags()...)
+	app.Before = func(c *cli.Context) error {
+		if err := secrets.SetupLogging(c); err != nil {
+			return err
+		}
+		if err := secrets.SetupAudit(c); err != nil {
+			return err
+		}
+		if err := secrets.SetupMetrics(c); err != nil {
+			return err
+		}
+		if err := secrets.SetupDaemon(c); err != nil {
+			return err
+		}
+		return secrets.SetupTracing(c)
+	}
+	app.Commands = append(app.Commands,
+		secrets.RenderCommand(),
+		secrets.ListCommand(),
+		secrets.StatusCommand(),
+		secrets.DoctorCommand(),
+		secrets.VerifyAuditCommand(),
+		secrets.CSICommand(backend),
+		secrets.ProviderCommand(backend),
+		secrets.DockerPluginCommand(backend),
+		secrets.DaemonCommand(backend),
+	)
 
 	app.Run(os.Args)
 }
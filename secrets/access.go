@@ -0,0 +1,76 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// hostFileAccessPath is where the host admin grants namespaces and service
+// accounts paths below fileSecretsRoot. Without it the file and sops
+// backends serve no volume.
+const hostFileAccessPath = "/var/lib/rancher/etc/secrets-access.json"
+
+// fileAccessRule grants the pods of a namespace, or of one service account
+// in it, the secretsPaths at or below Paths.
+type fileAccessRule struct {
+	Namespace      string   `json:"namespace"`
+	ServiceAccount string   `json:"serviceAccount,omitempty"`
+	Paths          []string `json:"paths"`
+}
+
+func loadFileAccessRules(file string) ([]fileAccessRule, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []fileAccessRule{}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("Invalid file access rules %s: %v", file, err)
+	}
+	return rules, nil
+}
+
+// authorizeSecretsPath fails unless a rule of the access file grants the pod
+// of the volume its secretsPath. An empty access file path, as used by
+// render, authorizes everything.
+func authorizeSecretsPath(accessFile string, options *options) error {
+	if accessFile == "" {
+		return nil
+	}
+
+	rules, err := loadFileAccessRules(accessFile)
+	if err != nil {
+		return err
+	}
+
+	want := path.Clean("/" + options.SecretsPath)
+	for _, rule := range rules {
+		if rule.Namespace == "" || rule.Namespace != options.PodNamespace {
+			continue
+		}
+		if rule.ServiceAccount != "" && rule.ServiceAccount != options.ServiceAccount {
+			continue
+		}
+
+		for _, p := range rule.Paths {
+			granted := path.Clean("/" + p)
+			if want == granted || strings.HasPrefix(want, strings.TrimSuffix(granted, "/")+"/") {
+				return nil
+			}
+		}
+	}
+
+	return &OptionError{
+		Option: "secretsPath",
+		Value:  options.SecretsPath,
+		Reason: fmt.Sprintf("not granted to service account %q of namespace %q", options.ServiceAccount, options.PodNamespace),
+	}
+}
@@ -0,0 +1,64 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestAuthorizeSecretsPath(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	accessFile := path.Join(tmpDir, "secrets-access.json")
+	grant := func(ns, sa, p string) *options {
+		return &options{PodNamespace: ns, ServiceAccount: sa, SecretsPath: p}
+	}
+
+	// Without an access file nothing is granted
+	if err := authorizeSecretsPath(accessFile, grant("default", "", "app")); err == nil {
+		t.Error("Expected missing access file to deny")
+	}
+
+	rules := `[
+		{"namespace": "default", "paths": ["app", "shared/db.yaml"]},
+		{"namespace": "web", "serviceAccount": "frontend", "paths": ["web/"]}
+	]`
+	if err := ioutil.WriteFile(accessFile, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		options *options
+		granted bool
+	}{
+		{grant("default", "", "app"), true},
+		{grant("default", "any", "/app/sub/"), true},
+		{grant("default", "", "shared/db.yaml"), true},
+		{grant("default", "", "application"), false},
+		{grant("default", "", "shared"), false},
+		{grant("default", "", "app/../web"), false},
+		{grant("default", "", ""), false},
+		{grant("web", "frontend", "web/static"), true},
+		{grant("web", "backend", "web"), false},
+		{grant("", "", "app"), false},
+		{grant("kube-system", "", "app"), false},
+	}
+	for _, c := range cases {
+		err := authorizeSecretsPath(accessFile, c.options)
+		if granted := err == nil; granted != c.granted {
+			t.Errorf("%+v: expected granted %v, got %v", c.options, c.granted, err)
+		}
+		if _, ok := err.(*OptionError); err != nil && !ok {
+			t.Errorf("Expected an OptionError, got %v", err)
+		}
+	}
+
+	if err := authorizeSecretsPath("", grant("", "", "anything")); err != nil {
+		t.Errorf("Expected render to read any path, got %v", err)
+	}
+}
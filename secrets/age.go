@@ -0,0 +1,96 @@
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
+)
+
+const ageArmorHeader = "-----BEGIN AGE ENCRYPTED FILE-----"
+
+var ageHeader = []byte("age-encryption.org/v1")
+
+type ageDecryptor struct {
+	identities []age.Identity
+}
+
+// NewAgeDecryptor returns a Decryptor for age encrypted files. Identities are
+// loaded from the native age identity file and the RSA host key, either of
+// which may be missing as long as one is present.
+func NewAgeDecryptor(identityPath, rsaKeyPath string) (Decryptor, error) {
+	identities := []age.Identity{}
+
+	if identityPath != "" {
+		f, err := os.Open(identityPath)
+		if err == nil {
+			defer f.Close()
+
+			ids, err := age.ParseIdentities(f)
+			if err != nil {
+				return nil, err
+			}
+			identities = append(identities, ids...)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	if rsaKeyPath != "" {
+		key, err := loadPrivateKeyFromFile(rsaKeyPath)
+		if err == nil {
+			id, err := agessh.NewRSAIdentity(key)
+			if err != nil {
+				return nil, err
+			}
+			identities = append(identities, id)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	if len(identities) == 0 {
+		return nil, errors.New("No age identities found for host")
+	}
+
+	return ageDecryptor{
+		identities: identities,
+	}, nil
+}
+
+// Decrypt implements the Decryptor interface. The cipherText is the base64
+// encoded age file, armored or binary.
+func (a ageDecryptor) Decrypt(cipherText string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(cipherText)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	var src io.Reader = bytes.NewReader(data)
+	if isAgeArmored(data) {
+		src = armor.NewReader(src)
+	}
+
+	r, err := age.Decrypt(src, a.identities...)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+func isAge(data []byte) bool {
+	return bytes.HasPrefix(data, ageHeader) || isAgeArmored(data)
+}
+
+func isAgeArmored(data []byte) bool {
+	line, _ := bufio.NewReader(bytes.NewReader(data)).ReadString('\n')
+	return string(bytes.TrimSpace([]byte(line))) == ageArmorHeader
+}
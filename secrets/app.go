@@ -0,0 +1,58 @@
+package secrets
+
+import (
+	"fmt"
+
+	flexvol "github.com/rancher/rancher-flexvol"
+	"github.com/urfave/cli"
+)
+
+// driverArgs is the number of arguments of each driver call
+var driverArgs = map[string]int{
+	"init":    0,
+	"attach":  1,
+	"detach":  1,
+	"mount":   3,
+	"unmount": 1,
+	"create":  1,
+	"delete":  1,
+}
+
+// NewApp returns the driver CLI of backend. Driver calls take their arguments
+// verbatim, and malformed ones always fail the call with a Failure response
+// rather than printing usage or crashing.
+func NewApp(backend flexvol.FlexDriver) *cli.App {
+	app := flexvol.NewApp(backend)
+
+	for i := range app.Commands {
+		cmd := &app.Commands[i]
+		n, ok := driverArgs[cmd.Name]
+		if !ok {
+			continue
+		}
+
+		// A JSON payload or path starting with - is not a flag
+		cmd.SkipFlagParsing = true
+		cmd.Action = checkedAction(cmd.Action, n)
+	}
+
+	return app
+}
+
+func checkedAction(action interface{}, args int) cli.ActionFunc {
+	return func(c *cli.Context) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("Driver call failed: %v", r)
+				flexvol.Error(err).Print()
+			}
+		}()
+
+		if c.NArg() < args {
+			flexvol.Error(flexvol.ErrIncorrectArgNumber).Print()
+			return flexvol.ErrIncorrectArgNumber
+		}
+
+		return cli.HandleAction(action, c)
+	}
+}
@@ -0,0 +1,33 @@
+package secrets
+
+import (
+	"testing"
+
+	flexvol "github.com/rancher/rancher-flexvol"
+)
+
+func TestNewAppMalformedArgs(t *testing.T) {
+	e, cleanup := newE2EEnv(t, WithMounter(func() (Mounter, error) { return newFakeMounter(), nil }))
+	defer cleanup()
+
+	tests := [][]string{
+		{"attach"},
+		{"attach", "-0"},
+		{"attach", "--help"},
+		{"mount", "/target"},
+		{"mount", "/target", "/device"},
+		{"unmount"},
+		{"detach", "-h"},
+	}
+
+	for _, args := range tests {
+		result := e.run(t, args...)
+		if result.Status != flexvol.StatusFailure {
+			t.Errorf("Expected %v to fail, got %+v", args, result)
+		}
+	}
+
+	if result := e.run(t, "init"); result.Status != flexvol.StatusSuccess {
+		t.Errorf("Expected init to succeed, got %+v", result)
+	}
+}
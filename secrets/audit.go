@@ -0,0 +1,363 @@
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	auditAttach  = "attach"
+	auditMount   = "mount"
+	auditUnmount = "unmount"
+	auditDetach  = "detach"
+	auditFetch   = "fetch"
+
+	auditSuccess = "success"
+	auditFailure = "failure"
+
+	// auditMACField is appended to the JSON of a chained event
+	auditMACField = `,"mac":"`
+)
+
+var (
+	// auditLogPath is where events are appended, empty disables the audit log
+	auditLogPath = path.Join(volRoot, "audit.log")
+	// auditKey chains events with HMAC-SHA256 when set
+	auditKey []byte
+
+	podDirUID = regexp.MustCompile(`/pods/([^/]+)/volumes/`)
+)
+
+// auditEvent is a line of the audit log. Secrets are identified by name and
+// content hash only. With a key every event carries the MAC of the one
+// before it in Prev, and its own MAC is computed over the exact JSON bytes
+// of the event and appended to the line, so it can be verified without
+// decoding.
+type auditEvent struct {
+	Time         time.Time     `json:"time"`
+	Seq          uint64        `json:"seq"`
+	Host         string        `json:"host"`
+	Action       string        `json:"action"`
+	Outcome      string        `json:"outcome"`
+	Error        string        `json:"error,omitempty"`
+	Volume       string        `json:"volume,omitempty"`
+	Device       string        `json:"device,omitempty"`
+	Target       string        `json:"target,omitempty"`
+	Backend      string        `json:"backend,omitempty"`
+	PodName      string        `json:"podName,omitempty"`
+	PodNamespace string        `json:"podNamespace,omitempty"`
+	PodUID       string        `json:"podUID,omitempty"`
+	Secrets      []auditSecret `json:"secrets,omitempty"`
+	Prev         string        `json:"prev,omitempty"`
+}
+
+type auditSecret struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// AuditFlags are the global flags configuring the audit log
+func AuditFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "audit-log", Value: auditLogPath, EnvVar: "SECRETS_FLEXVOL_AUDIT_LOG", Usage: "append audit events to this file, empty to disable"},
+		cli.StringFlag{Name: "audit-key", EnvVar: "SECRETS_FLEXVOL_AUDIT_KEY", Usage: "file holding the key that HMAC chains audit events"},
+	}
+}
+
+// SetupAudit configures the audit log from AuditFlags
+func SetupAudit(c *cli.Context) error {
+	auditLogPath = c.GlobalString("audit-log")
+
+	if keyFile := c.GlobalString("audit-key"); keyFile != "" {
+		key, err := readAuditKey(keyFile)
+		if err != nil {
+			return err
+		}
+		auditKey = key
+	}
+
+	return nil
+}
+
+// VerifyAuditCommand checks the HMAC chain of an audit log
+func VerifyAuditCommand() cli.Command {
+	return cli.Command{
+		Name:  "verify-audit",
+		Usage: "Verify the HMAC chain of the audit log",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "file", Value: auditLogPath, Usage: "audit log to verify"},
+			cli.StringFlag{Name: "key", EnvVar: "SECRETS_FLEXVOL_AUDIT_KEY", Usage: "file holding the audit key"},
+		},
+		Action: verifyAudit,
+	}
+}
+
+func verifyAudit(c *cli.Context) error {
+	if c.String("key") == "" {
+		return errors.New("--key is required")
+	}
+
+	key, err := readAuditKey(c.String("key"))
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(c.String("file"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := verifyAuditChain(f, key)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	fmt.Printf("%d events verified\n", n)
+	return nil
+}
+
+func readAuditKey(file string) ([]byte, error) {
+	key, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("Audit key %s is empty", file)
+	}
+	return key, nil
+}
+
+func newAuditEvent(action string) *auditEvent {
+	host, _ := os.Hostname()
+	return &auditEvent{
+		Action: action,
+		Host:   host,
+	}
+}
+
+func (e *auditEvent) withOptions(options *options) {
+	e.Volume = options.Name
+	e.Backend = options.Backend
+	if e.Backend == "" {
+		e.Backend = rancherBackend
+	}
+	e.PodName = options.PodName
+	e.PodNamespace = options.PodNamespace
+	e.PodUID = options.PodUID
+}
+
+func (e *auditEvent) withRecord(record *volumeRecord) {
+	e.Backend = record.Backend
+	e.PodName = record.PodName
+	e.PodNamespace = record.PodNamespace
+	e.PodUID = record.PodUID
+	e.withSecretRecords(record.Secrets)
+}
+
+func (e *auditEvent) withSecretRecords(secrets []secretRecord) {
+	e.Secrets = []auditSecret{}
+	for _, s := range secrets {
+		e.Secrets = append(e.Secrets, auditSecret{Name: s.Name, SHA256: s.SHA256})
+	}
+}
+
+func (e *auditEvent) withSecrets(secrets []secret) {
+	e.Secrets = []auditSecret{}
+	for _, s := range secrets {
+		e.Secrets = append(e.Secrets, auditSecret{Name: s.Name})
+	}
+}
+
+// withTarget records the bind mount target and the pod kubelet mounts it
+// for, which kubelet encodes in the path.
+func (e *auditEvent) withTarget(dir string) {
+	e.Target = dir
+	if m := podDirUID.FindStringSubmatch(dir); m != nil && e.PodUID == "" {
+		e.PodUID = m[1]
+	}
+}
+
+// emit appends the event with the outcome of err. Failing to audit does not
+// fail the driver call, it is logged instead.
+func (e *auditEvent) emit(err error) {
+	e.Outcome = auditSuccess
+	if err != nil {
+		e.Outcome = auditFailure
+		e.Error = logRedactor.scrub(err.Error())
+	}
+
+	if auditLogPath == "" {
+		return
+	}
+
+	if err := appendAuditEvent(auditLogPath, auditKey, e); err != nil {
+		logrus.Errorf("Failed to write audit event %s for %s: %v", e.Action, e.Volume, err)
+	}
+}
+
+// appendAuditEvent appends e under an exclusive lock on the log, continuing
+// the sequence and chain of the last event.
+func appendAuditEvent(file string, key []byte, e *auditEvent) error {
+	if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	last, err := lastLine(f)
+	if err != nil {
+		return err
+	}
+
+	e.Seq = 1
+	e.Prev = ""
+	if len(last) > 0 {
+		prev := auditEvent{}
+		if err := json.Unmarshal(last, &prev); err != nil {
+			return fmt.Errorf("Last audit event is corrupt: %v", err)
+		}
+		e.Seq = prev.Seq + 1
+		if key != nil {
+			e.Prev = auditMAC(last)
+		}
+	}
+	e.Time = time.Now().UTC()
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		mac := hex.EncodeToString(computeAuditMAC(key, line))
+		line = append(line[:len(line)-1], auditMACField+mac+`"}`...)
+	}
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// auditMAC returns the MAC stored on a chained line
+func auditMAC(line []byte) string {
+	i := bytes.LastIndex(line, []byte(auditMACField))
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSuffix(string(line[i+len(auditMACField):]), `"}`)
+}
+
+func computeAuditMAC(key, event []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(event)
+	return mac.Sum(nil)
+}
+
+// verifyAuditChain checks every line of the log and returns the number of
+// verified events, or an error naming the first line that breaks the chain.
+func verifyAuditChain(r io.Reader, key []byte) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var (
+		n       int
+		prevMAC string
+		prevSeq uint64
+	)
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		n++
+
+		i := bytes.LastIndex(line, []byte(auditMACField))
+		if i < 0 {
+			return n - 1, fmt.Errorf("Line %d: event is not chained", n)
+		}
+
+		event := append(append([]byte{}, line[:i]...), '}')
+		want := computeAuditMAC(key, event)
+		got, err := hex.DecodeString(auditMAC(line))
+		if err != nil || !hmac.Equal(want, got) {
+			return n - 1, fmt.Errorf("Line %d: MAC mismatch, event has been altered", n)
+		}
+
+		e := auditEvent{}
+		if err := json.Unmarshal(event, &e); err != nil {
+			return n - 1, fmt.Errorf("Line %d: %v", n, err)
+		}
+
+		if n == 1 && (e.Prev != "" || e.Seq != 1) {
+			return 0, errors.New("Line 1: log does not start with the first event")
+		}
+		if n > 1 && (e.Prev != prevMAC || e.Seq != prevSeq+1) {
+			return n - 1, fmt.Errorf("Line %d: chain broken, events have been removed or reordered", n)
+		}
+
+		prevMAC = hex.EncodeToString(got)
+		prevSeq = e.Seq
+	}
+
+	return n, scanner.Err()
+}
+
+// lastLine returns the last non empty line of f without reading all of it
+func lastLine(f *os.File) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	const chunk = 4096
+	var (
+		end  = fi.Size()
+		tail []byte
+	)
+
+	for end > 0 {
+		start := end - chunk
+		if start < 0 {
+			start = 0
+		}
+
+		buf := make([]byte, end-start)
+		if _, err := f.ReadAt(buf, start); err != nil && err != io.EOF {
+			return nil, err
+		}
+		tail = append(buf, tail...)
+		end = start
+
+		trimmed := bytes.TrimRight(tail, "\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return trimmed[i+1:], nil
+		}
+	}
+
+	return bytes.TrimRight(tail, "\n"), nil
+}
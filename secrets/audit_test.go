@@ -0,0 +1,90 @@
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestAuditChain(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	file := path.Join(tmpDir, "audit.log")
+	key := []byte("audit-key")
+
+	attach := newAuditEvent(auditAttach)
+	attach.withOptions(&options{Name: "vol", PodUID: "abc"})
+	attach.withSecretRecords([]secretRecord{{Name: "db_password", SHA256: "f52f"}})
+
+	mount := newAuditEvent(auditMount)
+	mount.Volume = "vol"
+	mount.withTarget("/var/lib/kubelet/pods/abc/volumes/rancher~secrets/vol")
+
+	detach := newAuditEvent(auditDetach)
+	detach.Volume = "vol"
+	detach.Outcome = auditFailure
+	detach.Error = "device busy"
+
+	for _, e := range []*auditEvent{attach, mount, detach} {
+		if err := appendAuditEvent(file, key, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if mount.Seq != 2 || mount.PodUID != "abc" {
+		t.Errorf("Unexpected mount event: %+v", mount)
+	}
+
+	content, _ := ioutil.ReadFile(file)
+	if n, err := verifyAuditChain(bytes.NewReader(content), key); err != nil || n != 3 {
+		t.Fatalf("Expected 3 verified events, got %d: %v", n, err)
+	}
+
+	if _, err := verifyAuditChain(bytes.NewReader(content), []byte("other-key")); err == nil {
+		t.Error("Expected a wrong key to fail verification")
+	}
+
+	lines := strings.SplitAfter(string(content), "\n")
+
+	altered := strings.Replace(string(content), "db_password", "db_passwore", 1)
+	if _, err := verifyAuditChain(strings.NewReader(altered), key); err == nil || !strings.HasPrefix(err.Error(), "Line 1:") {
+		t.Errorf("Expected altered line 1 to fail verification: %v", err)
+	}
+
+	removed := lines[0] + lines[2]
+	if _, err := verifyAuditChain(strings.NewReader(removed), key); err == nil || !strings.HasPrefix(err.Error(), "Line 2:") {
+		t.Errorf("Expected removed line to fail verification: %v", err)
+	}
+
+	truncated := lines[1] + lines[2]
+	if _, err := verifyAuditChain(strings.NewReader(truncated), key); err == nil {
+		t.Error("Expected truncated log to fail verification")
+	}
+}
+
+func TestAuditEventOutcome(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	defer func(orig string) { auditLogPath = orig }(auditLogPath)
+	auditLogPath = path.Join(tmpDir, "audit.log")
+
+	logRedactor.addValue("leaked-token")
+	newAuditEvent(auditAttach).emit(errors.New("bad token leaked-token"))
+
+	content, _ := ioutil.ReadFile(auditLogPath)
+	if !strings.Contains(string(content), `"outcome":"failure"`) || strings.Contains(string(content), "leaked-token") {
+		t.Errorf("Unexpected audit log: %s", content)
+	}
+}
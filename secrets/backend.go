@@ -0,0 +1,154 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"time"
+)
+
+// hostConfig holds the host paths the backends read keys and secrets from
+type hostConfig struct {
+	keyPath         string
+	ageIdentityPath string
+	keyringPath     string
+	fileSecretsRoot string
+	fileAccessPath  string
+	cacheDir        string
+	stateDir        string
+	stagingDir      string
+}
+
+func defaultHostConfig() hostConfig {
+	return hostConfig{
+		keyPath:         hostKeyPath,
+		ageIdentityPath: hostAgeIdentityPath,
+		keyringPath:     hostKeyringPath,
+		fileSecretsRoot: fileSecretsRoot,
+		fileAccessPath:  hostFileAccessPath,
+		cacheDir:        path.Join(volRoot, "cache"),
+		stateDir:        path.Join(volRoot, "state"),
+		stagingDir:      path.Join(volRoot, "staging"),
+	}
+}
+
+// instrumentDecryptor adds metrics and tracing to a backend's decryptor
+func instrumentDecryptor(decryptor Decryptor, backend string) Decryptor {
+	return tracedDecryptor{Decryptor: countingDecryptor{decryptor, backend}, backend: backend}
+}
+
+// newSecretBackend returns the getter and writer pair for the backend
+// selected in the volume options.
+func newSecretBackend(options *options, cfg hostConfig) (SecretGetter, SecretWriter, error) {
+	switch options.Backend {
+	case "", rancherBackend:
+		secretGetter, err := NewRancherSecretGetter(options)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if options.CacheTTL != "" {
+			secretGetter, err = newCachingSecretGetter(secretGetter, options, cfg)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		decryptor, err := NewRSADecryptor(cfg.keyPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		decryptor = instrumentDecryptor(decryptor, rancherBackend)
+
+		secretWriter, err := NewRSASecretFileWriter(decryptor)
+		return secretGetter, secretWriter, err
+	case fileBackend:
+		if err := authorizeSecretsPath(cfg.fileAccessPath, options); err != nil {
+			return nil, nil, err
+		}
+
+		secretGetter, err := NewFileSecretGetter(cfg.fileSecretsRoot, options)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		decryptor, err := NewHostFileDecryptor(cfg.ageIdentityPath, cfg.keyPath, cfg.keyringPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		decryptor = instrumentDecryptor(decryptor, options.Backend)
+
+		secretWriter, err := NewFileSecretWriter(decryptor)
+		return secretGetter, secretWriter, err
+	case sopsBackend:
+		if err := authorizeSecretsPath(cfg.fileAccessPath, options); err != nil {
+			return nil, nil, err
+		}
+
+		decryptor, err := NewHostFileDecryptor(cfg.ageIdentityPath, cfg.keyPath, cfg.keyringPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		decryptor = instrumentDecryptor(decryptor, options.Backend)
+
+		secretGetter, err := NewSOPSSecretGetter(cfg.fileSecretsRoot, options, decryptor)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		secretWriter, err := NewClearTextSecretWriter()
+		return secretGetter, secretWriter, err
+	case compositeBackend:
+		names := splitList(options.Backends)
+		if len(names) == 0 {
+			return nil, nil, errors.New("No backends given for composite backend")
+		}
+
+		getters := []SecretGetter{}
+		writers := map[string]SecretWriter{}
+		for _, name := range names {
+			if name == compositeBackend {
+				return nil, nil, errors.New("Composite backends can not be nested")
+			}
+			if _, ok := writers[name]; ok {
+				return nil, nil, fmt.Errorf("Backend %s listed more than once", name)
+			}
+
+			backendOptions := *options
+			backendOptions.Backend = name
+
+			getter, writer, err := newSecretBackend(&backendOptions, cfg)
+			if err != nil {
+				return nil, nil, err
+			}
+			getters = append(getters, getter)
+			writers[name] = writer
+		}
+
+		secretGetter, err := NewCompositeSecretGetter(names, getters, options.ConflictPolicy)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		secretWriter, err := NewCompositeSecretWriter(writers)
+		return secretGetter, secretWriter, err
+	}
+
+	return nil, nil, fmt.Errorf("Unknown secrets backend: %s", options.Backend)
+}
+
+func newCachingSecretGetter(getter SecretGetter, options *options, cfg hostConfig) (SecretGetter, error) {
+	ttl, err := time.ParseDuration(options.CacheTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	maxStale := ttl
+	if options.CacheMaxStale != "" {
+		if maxStale, err = time.ParseDuration(options.CacheMaxStale); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewCachingSecretGetter(getter, cfg.cacheDir, options, ttl, maxStale)
+}
@@ -0,0 +1,189 @@
+package secrets
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const cacheFileSuffix = ".json"
+
+// unavailableError marks a failure to reach the backend at all, as opposed
+// to the backend rejecting the request.
+type unavailableError struct {
+	err error
+}
+
+func (u unavailableError) Error() string {
+	return "Backend unavailable: " + u.err.Error()
+}
+
+func isUnavailable(err error) bool {
+	_, ok := err.(unavailableError)
+	return ok
+}
+
+type cacheEntry struct {
+	Fetched time.Time `json:"fetched"`
+	// MaxStale is that of the volume which stored the entry, for prune
+	MaxStale time.Duration `json:"maxStale,omitempty"`
+	Secrets  []secret      `json:"secrets"`
+}
+
+// NewCachingSecretGetter wraps a getter whose secrets are still encrypted,
+// such as the Rancher getter, and keeps the last successful response on disk.
+// It is used when the backend is unavailable and the entry is no older than
+// maxStale, entries older than ttl are logged as stale.
+func NewCachingSecretGetter(getter SecretGetter, dir string, params *options, ttl, maxStale time.Duration) (SecretGetter, error) {
+	if ttl <= 0 || maxStale < ttl {
+		return nil, fmt.Errorf("Invalid cache settings, need 0 < ttl (%s) <= maxStale (%s)", ttl, maxStale)
+	}
+
+	return &cachingSecretGetter{
+		getter:   getter,
+		dir:      dir,
+		key:      cacheKey(params),
+		ttl:      ttl,
+		maxStale: maxStale,
+	}, nil
+}
+
+func (csg cachingSecretGetter) GetSecrets(params *options) ([]secret, error) {
+	secrets, err := csg.getter.GetSecrets(params)
+	if err == nil {
+		if cErr := csg.store(secrets); cErr != nil {
+			logrus.Warnf("Failed to cache secrets: %v", cErr)
+		}
+		return secrets, nil
+	}
+
+	if !isUnavailable(err) {
+		return secrets, err
+	}
+
+	entry, cErr := csg.load()
+	if cErr != nil {
+		if !os.IsNotExist(cErr) {
+			logrus.Warnf("Failed to read secrets cache: %v", cErr)
+		}
+		return secrets, err
+	}
+
+	age := time.Since(entry.Fetched)
+	switch {
+	case age > csg.maxStale:
+		logrus.Warnf("Cached secrets for volume %s are %s old, beyond max staleness %s, not using them", params.Name, age, csg.maxStale)
+		os.Remove(csg.file())
+		return secrets, err
+	case age > csg.ttl:
+		logrus.Warnf("%v: using STALE cached secrets for volume %s fetched %s ago at %s", err, params.Name, age, entry.Fetched.Format(time.RFC3339))
+	default:
+		logrus.Infof("%v: using cached secrets for volume %s fetched at %s", err, params.Name, entry.Fetched.Format(time.RFC3339))
+	}
+
+	return entry.Secrets, nil
+}
+
+func (csg cachingSecretGetter) file() string {
+	return path.Join(csg.dir, csg.key+cacheFileSuffix)
+}
+
+func (csg cachingSecretGetter) load() (*cacheEntry, error) {
+	data, err := ioutil.ReadFile(csg.file())
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &cacheEntry{}
+	return entry, json.Unmarshal(data, entry)
+}
+
+func (csg cachingSecretGetter) store(secrets []secret) error {
+	if err := os.MkdirAll(csg.dir, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(cacheEntry{
+		Fetched:  time.Now().UTC(),
+		MaxStale: csg.maxStale,
+		Secrets:  secrets,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(csg.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), csg.file()); err != nil {
+		return err
+	}
+
+	csg.prune()
+	return nil
+}
+
+// prune removes entries of other volumes that can never be used again, each
+// by the maxStale of the volume that stored it. Entries written without one
+// fall back to ours.
+func (csg cachingSecretGetter) prune() {
+	files, err := ioutil.ReadDir(csg.dir)
+	if err != nil {
+		return
+	}
+
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), cacheFileSuffix) {
+			continue
+		}
+
+		file := path.Join(csg.dir, fi.Name())
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		entry := cacheEntry{}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			continue
+		}
+
+		maxStale := entry.MaxStale
+		if maxStale <= 0 {
+			maxStale = csg.maxStale
+		}
+		if time.Since(entry.Fetched) > maxStale {
+			os.Remove(file)
+		}
+	}
+}
+
+// cacheKey never contains the raw token so the cache directory listing does
+// not leak it.
+func cacheKey(params *options) string {
+	h := sha256.New()
+	h.Write([]byte(params.Name))
+	h.Write([]byte{0})
+	if params.Token != nil {
+		h.Write(params.Token.Value)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
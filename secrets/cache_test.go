@@ -0,0 +1,129 @@
+package secrets
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+type flakyGetter struct {
+	data []secret
+	err  error
+}
+
+func (fg *flakyGetter) GetSecrets(params *options) ([]secret, error) {
+	return fg.data, fg.err
+}
+
+func TestCachingGetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	params := &options{Name: "vol", Token: &secretToken{Value: []byte("onetime")}}
+	backend := &flakyGetter{data: tGet.Data}
+
+	getter, err := NewCachingSecretGetter(backend, dir, params, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := getter.GetSecrets(params); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || strings.Contains(files[0].Name(), "onetime") {
+		t.Fatalf("Expected one cache file not containing the token, got %v", files)
+	}
+	if files[0].Mode().Perm() != 0600 {
+		t.Errorf("Expected cache file mode 0600, got %v", files[0].Mode().Perm())
+	}
+
+	// Rejected requests are not masked by the cache
+	backend.data, backend.err = nil, errors.New("401 Unauthorized")
+	if _, err := getter.GetSecrets(params); err == nil {
+		t.Error("Expected rejection error to be returned")
+	}
+
+	backend.err = unavailableError{errors.New("connection refused")}
+	secrets, err := getter.GetSecrets(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != len(tGet.Data) || secrets[0].RewrapText != tGet.Data[0].RewrapText {
+		t.Errorf("Expected cached secrets, got %v", secrets)
+	}
+
+	// A different token is a different cache entry
+	other := &options{Name: "vol", Token: &secretToken{Value: []byte("other")}}
+	otherGetter, _ := NewCachingSecretGetter(backend, dir, other, time.Minute, time.Hour)
+	if _, err := otherGetter.GetSecrets(other); err == nil {
+		t.Error("Expected cache miss for a different token")
+	}
+
+	cacheFile := getter.(*cachingSecretGetter).file()
+	age := func(d time.Duration) {
+		data, _ := json.Marshal(cacheEntry{Fetched: time.Now().Add(-d), Secrets: tGet.Data})
+		ioutil.WriteFile(cacheFile, data, 0600)
+	}
+
+	age(30 * time.Minute)
+	if _, err := getter.GetSecrets(params); err != nil {
+		t.Errorf("Expected stale cache to be used, got %v", err)
+	}
+
+	age(2 * time.Hour)
+	if _, err := getter.GetSecrets(params); err == nil {
+		t.Error("Expected cache beyond max staleness to be refused")
+	}
+	if _, err := os.Stat(cacheFile); !os.IsNotExist(err) {
+		t.Error("Expected expired cache entry to be removed")
+	}
+
+	if _, err := NewCachingSecretGetter(backend, dir, params, time.Hour, time.Minute); err == nil {
+		t.Error("Expected maxStale below ttl to be rejected")
+	}
+}
+
+func TestCachePrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	entry := func(name string, fetched, maxStale time.Duration) string {
+		file := path.Join(dir, name+cacheFileSuffix)
+		data, _ := json.Marshal(cacheEntry{Fetched: time.Now().Add(-fetched), MaxStale: maxStale, Secrets: tGet.Data})
+		ioutil.WriteFile(file, data, 0600)
+		return file
+	}
+
+	// Each entry is kept for as long as the volume that stored it allows
+	longLived := entry("long", 2*time.Hour, 24*time.Hour)
+	expired := entry("expired", 2*time.Hour, time.Hour)
+	legacy := entry("legacy", 2*time.Hour, 0)
+
+	params := &options{Name: "vol", Token: &secretToken{Value: []byte("onetime")}}
+	getter, _ := NewCachingSecretGetter(&flakyGetter{data: tGet.Data}, dir, params, time.Minute, 90*time.Minute)
+	if _, err := getter.GetSecrets(params); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(longLived); err != nil {
+		t.Errorf("Expected entry within its own max staleness to be kept, got %v", err)
+	}
+	for _, file := range []string{expired, legacy} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("Expected expired entry %s to be removed", file)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package secrets
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	compositeBackend = "composite"
+
+	// FirstWins keeps the secret from the getter listed first
+	FirstWins = "first-wins"
+	// LastWins keeps the secret from the getter listed last
+	LastWins = "last-wins"
+	// ConflictError fails when two getters return the same secret name
+	ConflictError = "error"
+)
+
+// NewCompositeSecretGetter returns a SecretGetter that merges the secrets of
+// several getters. Precedence follows the order of names.
+func NewCompositeSecretGetter(names []string, getters []SecretGetter, policy string) (SecretGetter, error) {
+	if len(names) != len(getters) {
+		return nil, fmt.Errorf("Got %d backend names for %d getters", len(names), len(getters))
+	}
+
+	switch policy {
+	case "":
+		policy = FirstWins
+	case FirstWins, LastWins, ConflictError:
+	default:
+		return nil, fmt.Errorf("Unknown conflict policy: %s", policy)
+	}
+
+	return &compositeSecretGetter{
+		names:   names,
+		getters: getters,
+		policy:  policy,
+	}, nil
+}
+
+// GetSecrets fetches from all getters concurrently. Any getter failing fails
+// the whole set so a volume is never partially populated. Each getter gets
+// its own span, passed in its options as the parent of the spans it starts.
+func (csg compositeSecretGetter) GetSecrets(params *options) ([]secret, error) {
+	results := make([][]secret, len(csg.getters))
+	errs := make([]error, len(csg.getters))
+
+	parent := params.span
+	if parent == nil {
+		parent = currentSpan()
+	}
+
+	wg := sync.WaitGroup{}
+	for i, getter := range csg.getters {
+		wg.Add(1)
+		go func(i int, getter SecretGetter) {
+			defer wg.Done()
+
+			span := startSpanIn(parent, "GetSecrets", spanKindInternal)
+			span.setAttribute("backend", csg.names[i])
+
+			branch := *params
+			branch.span = span
+			results[i], errs[i] = getter.GetSecrets(&branch)
+			span.finish(errs[i])
+		}(i, getter)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return []secret{}, fmt.Errorf("%s backend: %v", csg.names[i], err)
+		}
+	}
+
+	returnSecrets := []secret{}
+	index := map[string]int{}
+
+	for i, secrets := range results {
+		for _, s := range secrets {
+			s.backend = csg.names[i]
+
+			existing, ok := index[s.Name]
+			if !ok {
+				index[s.Name] = len(returnSecrets)
+				returnSecrets = append(returnSecrets, s)
+				continue
+			}
+
+			prev := returnSecrets[existing].backend
+			switch csg.policy {
+			case ConflictError:
+				return []secret{}, fmt.Errorf("Secret %s provided by both %s and %s backends", s.Name, prev, s.backend)
+			case LastWins:
+				logrus.Infof("Secret %s from %s backend overrides %s", s.Name, s.backend, prev)
+				returnSecrets[existing] = s
+			default:
+				logrus.Infof("Secret %s from %s backend ignored, already provided by %s", s.Name, s.backend, prev)
+			}
+		}
+	}
+
+	return returnSecrets, nil
+}
+
+// NewCompositeSecretWriter returns a SecretWriter that hands each secret to
+// the writer of the backend it came from.
+func NewCompositeSecretWriter(writers map[string]SecretWriter) (SecretWriter, error) {
+	return &compositeSecretWriter{
+		writers: writers,
+	}, nil
+}
+
+func (csw compositeSecretWriter) Write(secrets []secret, dstDir string) error {
+	byBackend := map[string][]secret{}
+	order := []string{}
+
+	for _, s := range secrets {
+		if _, ok := csw.writers[s.backend]; !ok {
+			return fmt.Errorf("No writer for secret %s from backend %q", s.Name, s.backend)
+		}
+		if _, ok := byBackend[s.backend]; !ok {
+			order = append(order, s.backend)
+		}
+		byBackend[s.backend] = append(byBackend[s.backend], s)
+	}
+
+	for _, backend := range order {
+		if err := csw.writers[backend].Write(byBackend[backend], dstDir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitList splits a comma separated option value
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
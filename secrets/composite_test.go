@@ -0,0 +1,99 @@
+package secrets
+
+import (
+	"errors"
+	"testing"
+)
+
+type recordingWriter struct {
+	written *[]string
+}
+
+func (rw recordingWriter) Write(secrets []secret, dst string) error {
+	for _, s := range secrets {
+		*rw.written = append(*rw.written, s.backend+":"+s.Name)
+	}
+	return nil
+}
+
+type failingGetter struct{}
+
+func (fg failingGetter) GetSecrets(params *options) ([]secret, error) {
+	return nil, errors.New("unreachable")
+}
+
+func TestCompositeGetter(t *testing.T) {
+	rancher := testGetter{Data: []secret{{Name: "a", RewrapText: "rancher-a"}, {Name: "b", RewrapText: "rancher-b"}}}
+	file := testGetter{Data: []secret{{Name: "b", RewrapText: "file-b"}, {Name: "c", RewrapText: "file-c"}}}
+
+	tests := map[string]map[string]string{
+		FirstWins: {"a": "rancher-a", "b": "rancher-b", "c": "file-c"},
+		LastWins:  {"a": "rancher-a", "b": "file-b", "c": "file-c"},
+	}
+
+	for policy, expected := range tests {
+		getter, err := NewCompositeSecretGetter([]string{"rancher", "file"}, []SecretGetter{rancher, file}, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		secrets, err := getter.GetSecrets(paramFixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(secrets) != len(expected) {
+			t.Errorf("%s: expected %d secrets, got %d", policy, len(expected), len(secrets))
+		}
+		for _, s := range secrets {
+			if expected[s.Name] != s.RewrapText {
+				t.Errorf("%s: secret %s, expected %s got %s", policy, s.Name, expected[s.Name], s.RewrapText)
+			}
+		}
+	}
+
+	getter, _ := NewCompositeSecretGetter([]string{"rancher", "file"}, []SecretGetter{rancher, file}, ConflictError)
+	if _, err := getter.GetSecrets(paramFixture); err == nil {
+		t.Error("Expected conflict error")
+	}
+
+	getter, _ = NewCompositeSecretGetter([]string{"rancher", "file"}, []SecretGetter{rancher, failingGetter{}}, FirstWins)
+	if _, err := getter.GetSecrets(paramFixture); err == nil {
+		t.Error("Expected error from failing getter")
+	}
+
+	if _, err := NewCompositeSecretGetter([]string{"rancher"}, []SecretGetter{rancher}, "random"); err == nil {
+		t.Error("Expected unknown policy error")
+	}
+}
+
+func TestCompositeWriter(t *testing.T) {
+	written := []string{}
+	sw, _ := NewCompositeSecretWriter(map[string]SecretWriter{
+		"rancher": recordingWriter{&written},
+		"file":    recordingWriter{&written},
+	})
+
+	secrets := []secret{
+		{Name: "a", backend: "rancher"},
+		{Name: "b", backend: "file"},
+		{Name: "c", backend: "rancher"},
+	}
+	if err := sw.Write(secrets, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"rancher:a", "rancher:c", "file:b"}
+	if len(written) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, written)
+	}
+	for i := range expected {
+		if written[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, written)
+		}
+	}
+
+	if err := sw.Write([]secret{{Name: "d", backend: "sops"}}, ""); err == nil {
+		t.Error("Expected error for backend without writer")
+	}
+}
@@ -0,0 +1,316 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/urfave/cli"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	defaultCSIDriverName = "secrets.csi.rancher.io"
+	defaultCSIEndpoint   = "unix:///csi/csi.sock"
+
+	// csiPodPrefix prefixes the pod information kubelet adds to the volume
+	// context when podInfoOnMount is set on the CSIDriver
+	csiPodPrefix = "csi.storage.k8s.io/"
+)
+
+// csiPodInfo maps the pod information of the volume context onto the
+// FlexVolume options kubelet passes.
+var csiPodInfo = map[string]string{
+	"csi.storage.k8s.io/pod.name":                  "kubernetes.io/pod.name",
+	"csi.storage.k8s.io/pod.namespace":             "kubernetes.io/pod.namespace",
+	"csi.storage.k8s.io/pod.uid":                   "kubernetes.io/pod.uid",
+	"csi.storage.k8s.io/serviceAccount.name":       "kubernetes.io/serviceAccount.name",
+	"csi.storage.k8s.io/ephemeral":                 "",
+	"csi.storage.k8s.io/serviceAccount.tokens":     "",
+	"csi.storage.k8s.io/pvc/name":                  "",
+	"csi.storage.k8s.io/pvc/namespace":             "",
+	"csi.storage.k8s.io/pv/name":                   "",
+	"storage.kubernetes.io/csiProvisionerIdentity": "",
+}
+
+// CSICommand serves the CSI Identity and Node services for backend, so
+// secrets can be mounted as ephemeral inline CSI volumes.
+func CSICommand(backend *FlexVolume) cli.Command {
+	return cli.Command{
+		Name:  "csi",
+		Usage: "Serve the CSI node plugin",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "endpoint", Value: defaultCSIEndpoint, EnvVar: "CSI_ENDPOINT", Usage: "unix socket to serve on"},
+			cli.StringFlag{Name: "node-id", EnvVar: "KUBE_NODE_NAME,NODE_ID", Usage: "node ID, defaults to the hostname"},
+			cli.StringFlag{Name: "driver-name", Value: defaultCSIDriverName, Usage: "name the driver is registered under"},
+		},
+		Action: func(c *cli.Context) error {
+			nodeID := c.String("node-id")
+			if nodeID == "" {
+				host, err := os.Hostname()
+				if err != nil {
+					return err
+				}
+				nodeID = host
+			}
+
+			listener, err := listenCSI(c.String("endpoint"))
+			if err != nil {
+				return err
+			}
+
+			server := newCSIServer(newCSIDriver(backend, c.String("driver-name"), c.App.Version, nodeID))
+
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			go func() {
+				<-signals
+				server.GracefulStop()
+			}()
+
+			logrus.Infof("Serving CSI node plugin %s on %s", c.String("driver-name"), c.String("endpoint"))
+			return server.Serve(listener)
+		},
+	}
+}
+
+// listenCSI listens on a unix:// endpoint, replacing a stale socket. It
+// refuses to replace the socket of a server that still answers, and creates
+// the socket accessible to its owner only.
+func listenCSI(endpoint string) (net.Listener, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "unix" {
+		return nil, fmt.Errorf("Unsupported CSI endpoint %s, only unix:// is supported", endpoint)
+	}
+
+	socket := u.Path
+	if socket == "" {
+		socket = u.Host
+	}
+	if err := os.MkdirAll(path.Dir(socket), 0750); err != nil {
+		return nil, err
+	}
+
+	if conn, err := net.DialTimeout("unix", socket, daemonDialTimeout); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("Another server is listening on %s", socket)
+	}
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// The socket is created with the umask, so there is no window in which
+	// others may connect
+	umask := syscall.Umask(0177)
+	defer syscall.Umask(umask)
+	return net.Listen("unix", socket)
+}
+
+func newCSIServer(driver *csiDriver) *grpc.Server {
+	server := grpc.NewServer()
+	csi.RegisterIdentityServer(server, driver)
+	csi.RegisterNodeServer(server, driver)
+	return server
+}
+
+// csiDriver implements the CSI Identity and Node services on a FlexVolume.
+// The driver keeps per call state in package variables, as every FlexVolume
+// call is its own process, so CSI calls are serialized.
+type csiDriver struct {
+	csi.UnimplementedIdentityServer
+	csi.UnimplementedNodeServer
+
+	mu      sync.Mutex
+	sv      *FlexVolume
+	name    string
+	version string
+	nodeID  string
+}
+
+func newCSIDriver(sv *FlexVolume, name, version, nodeID string) *csiDriver {
+	return &csiDriver{
+		sv:      sv,
+		name:    name,
+		version: version,
+		nodeID:  nodeID,
+	}
+}
+
+func (d *csiDriver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{
+		Name:          d.name,
+		VendorVersion: d.version,
+	}, nil
+}
+
+func (d *csiDriver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	return &csi.GetPluginCapabilitiesResponse{}, nil
+}
+
+func (d *csiDriver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{Ready: wrapperspb.Bool(true)}, nil
+}
+
+func (d *csiDriver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{}, nil
+}
+
+func (d *csiDriver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{NodeId: d.nodeID}, nil
+}
+
+// NodePublishVolume attaches the volume like FlexVolume attach and bind
+// mounts it on the target. Publishing a published volume succeeds.
+func (d *csiDriver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing")
+	}
+	if req.GetTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing")
+	}
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return nil, status.Error(codes.InvalidArgument, "Block volumes are not supported")
+	}
+	if err := isFileName(req.GetVolumeId()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Volume ID %q %v", req.GetVolumeId(), err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	target := req.GetTargetPath()
+	mounted, err := d.sv.getMounter().Mounted(target)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if mounted {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	device, err := d.sv.Attach(csiParams(req))
+	if err != nil {
+		return nil, csiError(err)
+	}
+
+	// Nothing unpublishes a volume that failed to publish, so drop the
+	// secrets again
+	if err := os.MkdirAll(target, 0750); err != nil {
+		d.detach(device)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if err := d.sv.Mount(target, device, map[string]interface{}{"readOnly": req.GetReadonly()}); err != nil {
+		d.detach(device)
+		return nil, csiError(err)
+	}
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (d *csiDriver) detach(device string) {
+	if err := d.sv.Detach(device); err != nil {
+		logrus.Warnf("Failed to detach %s after failing to publish it: %v", device, err)
+	}
+}
+
+// NodeUnpublishVolume unmounts the target and detaches the volume.
+// Unpublishing a volume that is not published succeeds.
+func (d *csiDriver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing")
+	}
+	if req.GetTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing")
+	}
+	if err := isFileName(req.GetVolumeId()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Volume ID %q %v", req.GetVolumeId(), err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	target := req.GetTargetPath()
+	mounted, err := d.sv.getMounter().Mounted(target)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if mounted {
+		if err := d.sv.Unmount(target); err != nil {
+			return nil, csiError(err)
+		}
+	} else if err := os.RemoveAll(target); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	device := path.Join(d.sv.config().stagingDir, req.GetVolumeId())
+	if _, err := os.Stat(device); os.IsNotExist(err) {
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+	if err := d.sv.Detach(device); err != nil {
+		return nil, csiError(err)
+	}
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// csiParams turns the volume context and secrets of a publish request into
+// the options of FlexVolume attach. The token is taken from the
+// nodePublishSecretRef, or the volume attributes.
+func csiParams(req *csi.NodePublishVolumeRequest) map[string]interface{} {
+	return volumeContextParams(req.GetVolumeContext(), req.GetSecrets(), req.GetVolumeId())
+}
+
+// volumeContextParams maps CSI volume attributes, with the pod information
+// kubelet adds, and the token of secrets onto the options of volume name.
+func volumeContextParams(volumeContext, secrets map[string]string, name string) map[string]interface{} {
+	params := map[string]interface{}{}
+	for k, v := range volumeContext {
+		if flexKey, ok := csiPodInfo[k]; ok {
+			if flexKey != "" {
+				params[flexKey] = v
+			}
+			continue
+		}
+		// Pod information is only taken from kubelet, never from attributes
+		if strings.HasPrefix(k, csiPodPrefix) || strings.HasPrefix(k, kubeletPrefix) {
+			continue
+		}
+		params[k] = v
+	}
+
+	if token, ok := secrets[tokenOption]; ok {
+		params[tokenOption] = token
+	}
+
+	params["name"] = name
+	return params
+}
+
+// csiError maps driver errors onto gRPC status codes
+func csiError(err error) error {
+	if _, ok := err.(*OptionError); ok {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if isUnavailable(err) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
@@ -0,0 +1,284 @@
+package secrets
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// newTestCSI serves the CSI plugin on a socket in a temp dir, backed by the
+// test getter and decryptor on a fake mount table.
+func newTestCSI(t *testing.T) (*grpc.ClientConn, *fakeMounter, string, func()) {
+	tmpDir, err := ioutil.TempDir("", "csi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	origAuditLogPath := auditLogPath
+	auditLogPath = path.Join(tmpDir, "audit.log")
+
+	mounter := newFakeMounter()
+	sv, err := NewFlexVolume(
+		WithSecretGetter(func(*Options) (SecretGetter, error) { return tGet, nil }),
+		WithDecryptor(func(*Options) (Decryptor, error) { return testDecryptor{}, nil }),
+		WithMounter(func() (Mounter, error) { return mounter, nil }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sv.cfg.stateDir = path.Join(tmpDir, "state")
+	sv.cfg.stagingDir = path.Join(tmpDir, "staging")
+
+	endpoint := "unix://" + path.Join(tmpDir, "plugin", "csi.sock")
+	listener, err := listenCSI(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newCSIServer(newCSIDriver(sv, defaultCSIDriverName, "v1.0.0", "node-1"))
+	go server.Serve(listener)
+
+	conn, err := grpc.Dial(endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, mounter, tmpDir, func() {
+		conn.Close()
+		server.Stop()
+		auditLogPath = origAuditLogPath
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func TestListenCSI(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "csi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	socket := path.Join(tmpDir, "plugin", "csi.sock")
+	listener, err := listenCSI("unix://" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(socket); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected the socket to be created 0600, got %v: %v", fi.Mode(), err)
+	}
+
+	if _, err := listenCSI("unix://" + socket); err == nil {
+		t.Error("Expected the socket of a live server to be kept")
+	}
+
+	// A socket left behind by a server that is gone is replaced
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	if listener, err = listenCSI("unix://" + socket); err != nil {
+		t.Fatalf("Expected a stale socket to be replaced, got %v", err)
+	}
+	listener.Close()
+}
+
+func TestCSIIdentity(t *testing.T) {
+	conn, _, _, cleanup := newTestCSI(t)
+	defer cleanup()
+
+	identity := csi.NewIdentityClient(conn)
+	ctx := context.Background()
+
+	info, err := identity.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.GetName() != defaultCSIDriverName || info.GetVendorVersion() == "" {
+		t.Errorf("Unexpected plugin info %v", info)
+	}
+
+	if _, err := identity.GetPluginCapabilities(ctx, &csi.GetPluginCapabilitiesRequest{}); err != nil {
+		t.Error(err)
+	}
+
+	probe, err := identity.Probe(ctx, &csi.ProbeRequest{})
+	if err != nil || !probe.GetReady().GetValue() {
+		t.Errorf("Expected plugin to be ready, got %v: %v", probe, err)
+	}
+
+	node := csi.NewNodeClient(conn)
+	nodeInfo, err := node.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	if err != nil || nodeInfo.GetNodeId() != "node-1" {
+		t.Errorf("Unexpected node info %v: %v", nodeInfo, err)
+	}
+
+	caps, err := node.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range caps.GetCapabilities() {
+		if c.GetRpc().GetType() == csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME {
+			t.Error("Staging is advertised but not implemented")
+		}
+	}
+}
+
+func mountCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+func TestCSINodePublish(t *testing.T) {
+	conn, mounter, tmpDir, cleanup := newTestCSI(t)
+	defer cleanup()
+
+	node := csi.NewNodeClient(conn)
+	ctx := context.Background()
+	target := path.Join(tmpDir, "pods", "abc", "volumes", "kubernetes.io~csi", "secrets", "mount")
+
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:         "csi-0123456789",
+		TargetPath:       target,
+		VolumeCapability: mountCapability(),
+		Readonly:         true,
+		VolumeContext: map[string]string{
+			"csi.storage.k8s.io/pod.name":      "web-0",
+			"csi.storage.k8s.io/pod.namespace": "default",
+			"csi.storage.k8s.io/pod.uid":       "abc",
+			"csi.storage.k8s.io/ephemeral":     "true",
+			"sizeLimit":                        "1m",
+		},
+		Secrets: map[string]string{tokenOption: "onetime"},
+	}
+
+	// Publishing is idempotent
+	for i := 0; i < 2; i++ {
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	device := path.Join(tmpDir, "staging", req.VolumeId)
+	if m, ok := mounter.mounts[target]; !ok || m.device != device || m.options != "bind,ro" {
+		t.Errorf("Unexpected bind mount %+v", m)
+	}
+	for name, value := range expectedValues {
+		if content, err := ioutil.ReadFile(path.Join(device, name)); err != nil || string(content) != value {
+			t.Errorf("Unexpected %s %q: %v", name, content, err)
+		}
+	}
+
+	record, err := getVolumeRecord(newStateStore(path.Join(tmpDir, "state")), req.VolumeId)
+	if err != nil || record.PodName != "web-0" || record.PodUID != "abc" {
+		t.Errorf("Pod not recorded: %+v: %v", record, err)
+	}
+
+	// Unpublishing is idempotent
+	unpublish := &csi.NodeUnpublishVolumeRequest{VolumeId: req.VolumeId, TargetPath: target}
+	for i := 0; i < 2; i++ {
+		if _, err := node.NodeUnpublishVolume(ctx, unpublish); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(mounter.mounts) != 0 {
+		t.Errorf("Mounts left after unpublish: %v", mounter.mounts)
+	}
+	if _, err := os.Stat(device); !os.IsNotExist(err) {
+		t.Error("Device not removed by unpublish")
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Error("Target not removed by unpublish")
+	}
+}
+
+func TestCSINodePublishFailure(t *testing.T) {
+	conn, mounter, tmpDir, cleanup := newTestCSI(t)
+	defer cleanup()
+
+	// The target cannot be created below a file
+	ioutil.WriteFile(path.Join(tmpDir, "pods"), nil, 0600)
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:         "csi-0123456789",
+		TargetPath:       path.Join(tmpDir, "pods", "abc", "mount"),
+		VolumeCapability: mountCapability(),
+		Secrets:          map[string]string{tokenOption: "onetime"},
+	}
+
+	if _, err := csi.NewNodeClient(conn).NodePublishVolume(context.Background(), req); err == nil {
+		t.Fatal("Expected publish to fail")
+	}
+	if len(mounter.mounts) != 0 {
+		t.Errorf("Mounts left after failed publish: %v", mounter.mounts)
+	}
+	if _, err := os.Stat(path.Join(tmpDir, "staging", req.VolumeId)); !os.IsNotExist(err) {
+		t.Error("Device not removed after failed publish")
+	}
+}
+
+func TestCSIInvalidArguments(t *testing.T) {
+	conn, _, tmpDir, cleanup := newTestCSI(t)
+	defer cleanup()
+
+	node := csi.NewNodeClient(conn)
+	ctx := context.Background()
+	target := path.Join(tmpDir, "target")
+
+	publish := []*csi.NodePublishVolumeRequest{
+		{TargetPath: target, VolumeCapability: mountCapability()},
+		{VolumeId: "vol", VolumeCapability: mountCapability()},
+		{VolumeId: "vol", TargetPath: target},
+		{VolumeId: "../vol", TargetPath: target, VolumeCapability: mountCapability()},
+		{VolumeId: "vol", TargetPath: target, VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		}},
+		// Without a token the Rancher backend cannot be used
+		{VolumeId: "vol", TargetPath: target, VolumeCapability: mountCapability()},
+	}
+	for _, req := range publish {
+		if _, err := node.NodePublishVolume(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument for %v, got %v", req, err)
+		}
+	}
+
+	unpublish := []*csi.NodeUnpublishVolumeRequest{
+		{TargetPath: target},
+		{VolumeId: "vol"},
+	}
+	for _, req := range unpublish {
+		if _, err := node.NodeUnpublishVolume(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument for %v, got %v", req, err)
+		}
+	}
+
+	if _, err := node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("Expected staging to be unimplemented, got %v", err)
+	}
+}
+
+func TestCSIParamsPodInfo(t *testing.T) {
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId: "vol",
+		VolumeContext: map[string]string{
+			"csi.storage.k8s.io/pod.namespace":  "default",
+			"kubernetes.io/pod.namespace":       "kube-system",
+			"kubernetes.io/serviceAccount.name": "admin",
+			"secretsPath":                       "app",
+		},
+	}
+
+	params := csiParams(req)
+	if params["kubernetes.io/pod.namespace"] != "default" || params["secretsPath"] != "app" {
+		t.Errorf("Unexpected params %v", params)
+	}
+	if _, ok := params["kubernetes.io/serviceAccount.name"]; ok {
+		t.Errorf("Service account taken from the volume attributes: %v", params)
+	}
+}
@@ -0,0 +1,352 @@
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	daemonCallPath    = "/v1/call"
+	daemonDialTimeout = time.Second
+)
+
+var (
+	// daemonSocket is where driver calls are forwarded to the daemon, empty
+	// always runs them in process
+	daemonSocket = path.Join(volRoot, "daemon.sock")
+
+	// daemonCallTimeout bounds a forwarded call, below the two minutes
+	// kubelet gives a volume operation, so a stuck daemon fails the call
+	// instead of hanging kubelet
+	daemonCallTimeout = 90 * time.Second
+)
+
+// DaemonFlags are the global flags configuring the daemon socket
+func DaemonFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "daemon-socket", Value: daemonSocket, EnvVar: "SECRETS_FLEXVOL_DAEMON_SOCKET", Usage: "forward driver calls to the daemon on this socket, empty to disable"},
+	}
+}
+
+// SetupDaemon configures the daemon socket from DaemonFlags
+func SetupDaemon(c *cli.Context) error {
+	daemonSocket = c.GlobalString("daemon-socket")
+	return nil
+}
+
+// DaemonCommand runs backend as a long running node agent. Driver calls are
+// forwarded to it by the DaemonClient, so the host key, the connections to
+// Rancher and the state are kept between calls.
+func DaemonCommand(backend *FlexVolume) cli.Command {
+	return cli.Command{
+		Name:  "daemon",
+		Usage: "Serve driver calls on the daemon socket",
+		Flags: []cli.Flag{
+			cli.DurationFlag{Name: "refresh-interval", Value: time.Minute, Usage: "how often to reload the host key, prune tokens and write metrics"},
+		},
+		Action: func(c *cli.Context) error {
+			if daemonSocket == "" {
+				return errors.New("--daemon-socket is required")
+			}
+
+			listener, err := listenCSI("unix://" + daemonSocket)
+			if err != nil {
+				return err
+			}
+
+			d := newDaemon(backend)
+			server := &http.Server{Handler: d}
+
+			done := make(chan struct{})
+			defer close(done)
+			go d.refreshLoop(c.Duration("refresh-interval"), done)
+
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			go func() {
+				<-signals
+				server.Close()
+			}()
+
+			logrus.Infof("Serving driver calls on %s", daemonSocket)
+			if err := server.Serve(listener); err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+// daemonRequest is a driver call with the arguments kubelet passed, and the
+// trace context of the caller
+type daemonRequest struct {
+	Command     string                 `json:"command"`
+	Options     map[string]interface{} `json:"options,omitempty"`
+	Device      string                 `json:"device,omitempty"`
+	Dir         string                 `json:"dir,omitempty"`
+	Traceparent string                 `json:"traceparent,omitempty"`
+}
+
+type daemonResponse struct {
+	Device  string                 `json:"device,omitempty"`
+	Options map[string]interface{} `json:"options,omitempty"`
+	Error   string                 `json:"error,omitempty"`
+}
+
+// daemon serves driver calls on a FlexVolume. Calls are serialized, the same
+// as the CSI driver, which also lets concurrent calls for a volume see each
+// other's effects.
+type daemon struct {
+	mu sync.Mutex
+	sv *FlexVolume
+}
+
+func newDaemon(sv *FlexVolume) *daemon {
+	return &daemon{sv: sv}
+}
+
+func (d *daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.URL.Path != daemonCallPath {
+		http.NotFound(w, r)
+		return
+	}
+
+	req := &daemonRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(d.call(req)); err != nil {
+		logrus.Errorf("Failed to write response to %s: %v", req.Command, err)
+	}
+}
+
+func (d *daemon) call(req *daemonRequest) *daemonResponse {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Each call continues the trace of its caller or starts its own
+	defer activeTracer.continueTrace(req.Traceparent)()
+
+	if req.Options == nil {
+		req.Options = map[string]interface{}{}
+	}
+
+	resp := &daemonResponse{}
+	var err error
+	switch req.Command {
+	case "init":
+		err = d.sv.Init()
+	case "attach":
+		resp.Device, err = d.sv.Attach(req.Options)
+	case "detach":
+		err = d.sv.Detach(req.Device)
+	case "mount":
+		err = d.sv.Mount(req.Dir, req.Device, req.Options)
+	case "unmount":
+		err = d.sv.Unmount(req.Dir)
+	case "create":
+		resp.Options, err = d.sv.Create(req.Options)
+	case "delete":
+		err = d.sv.Delete(req.Options)
+	default:
+		err = fmt.Errorf("Unknown command %q", req.Command)
+	}
+
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+func (d *daemon) refreshLoop(interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		d.refresh()
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// refresh reloads the host key if it changed, drops expired token records
+// and writes the metrics, so active volumes are current between calls.
+func (d *daemon) refresh() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	cfg := d.sv.config()
+	if _, err := loadPrivateKeyFromFile(cfg.keyPath); err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("Failed to load host key %s: %v", cfg.keyPath, err)
+	}
+
+	store := newStateStore(cfg.stateDir)
+	if unlock, err := store.lock(); err != nil {
+		logrus.Warnf("Failed to lock state: %v", err)
+	} else {
+		pruneTokens(store)
+		unlock()
+	}
+
+	if err := flushMetrics(store, metricsDir); err != nil {
+		logrus.Warnf("Failed to write metrics: %v", err)
+	}
+}
+
+// DaemonClient is a driver that forwards every call to the daemon, and runs
+// it on the fallback in process when no daemon is listening. Once the
+// daemon accepted a call it is never run again in process.
+type DaemonClient struct {
+	fallback *FlexVolume
+}
+
+// NewDaemonClient returns a DaemonClient falling back to backend
+func NewDaemonClient(backend *FlexVolume) *DaemonClient {
+	return &DaemonClient{fallback: backend}
+}
+
+// call forwards req to the daemon. forwarded is false when there is no
+// daemon to forward to.
+func (c *DaemonClient) call(req *daemonRequest) (resp *daemonResponse, forwarded bool, err error) {
+	if daemonSocket == "" {
+		return nil, false, nil
+	}
+
+	conn, err := net.DialTimeout("unix", daemonSocket, daemonDialTimeout)
+	if err != nil {
+		logrus.Debugf("No daemon on %s, running %s in process: %v", daemonSocket, req.Command, err)
+		return nil, false, nil
+	}
+	defer conn.Close()
+
+	defer func() {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			err = fmt.Errorf("Daemon on %s did not answer %s within %s, it may still complete", daemonSocket, req.Command, daemonCallTimeout)
+		}
+	}()
+	if err := conn.SetDeadline(time.Now().Add(daemonCallTimeout)); err != nil {
+		return nil, true, err
+	}
+
+	req.Traceparent = callerTraceparent
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, true, err
+	}
+
+	httpReq, err := http.NewRequest("POST", "http://daemon"+daemonCallPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, true, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	if err := httpReq.Write(conn); err != nil {
+		return nil, true, err
+	}
+
+	httpResp, err := http.ReadResponse(bufio.NewReader(conn), httpReq)
+	if err != nil {
+		return nil, true, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(httpResp.Body)
+		return nil, true, fmt.Errorf("Daemon refused %s: %s: %s", req.Command, httpResp.Status, bytes.TrimSpace(msg))
+	}
+
+	resp = &daemonResponse{}
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return nil, true, err
+	}
+	if resp.Error != "" {
+		return resp, true, errors.New(resp.Error)
+	}
+	return resp, true, nil
+}
+
+// Init is run in process, there is nothing to initialize in the daemon
+func (c *DaemonClient) Init() error {
+	return c.fallback.Init()
+}
+
+// Attach forwards attach to the daemon
+func (c *DaemonClient) Attach(params map[string]interface{}) (string, error) {
+	resp, forwarded, err := c.call(&daemonRequest{Command: "attach", Options: params})
+	if !forwarded {
+		return c.fallback.Attach(params)
+	}
+	if err != nil {
+		return "", err
+	}
+	return resp.Device, nil
+}
+
+// Detach forwards detach to the daemon
+func (c *DaemonClient) Detach(device string) error {
+	_, forwarded, err := c.call(&daemonRequest{Command: "detach", Device: device})
+	if !forwarded {
+		return c.fallback.Detach(device)
+	}
+	return err
+}
+
+// Mount forwards mount to the daemon
+func (c *DaemonClient) Mount(dir, device string, params map[string]interface{}) error {
+	_, forwarded, err := c.call(&daemonRequest{Command: "mount", Dir: dir, Device: device, Options: params})
+	if !forwarded {
+		return c.fallback.Mount(dir, device, params)
+	}
+	return err
+}
+
+// Unmount forwards unmount to the daemon
+func (c *DaemonClient) Unmount(dir string) error {
+	_, forwarded, err := c.call(&daemonRequest{Command: "unmount", Dir: dir})
+	if !forwarded {
+		return c.fallback.Unmount(dir)
+	}
+	return err
+}
+
+// Create forwards create to the daemon
+func (c *DaemonClient) Create(params map[string]interface{}) (map[string]interface{}, error) {
+	resp, forwarded, err := c.call(&daemonRequest{Command: "create", Options: params})
+	if !forwarded {
+		return c.fallback.Create(params)
+	}
+	if err != nil {
+		return map[string]interface{}{}, err
+	}
+	return resp.Options, nil
+}
+
+// Delete forwards delete to the daemon
+func (c *DaemonClient) Delete(params map[string]interface{}) error {
+	_, forwarded, err := c.call(&daemonRequest{Command: "delete", Options: params})
+	if !forwarded {
+		return c.fallback.Delete(params)
+	}
+	return err
+}
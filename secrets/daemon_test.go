@@ -0,0 +1,204 @@
+package secrets
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestDaemon serves the daemon for an e2e env on a socket in its temp dir
+// and returns a client whose fallback has a mount table of its own, so it
+// shows where calls ran.
+func newTestDaemon(t *testing.T) (*e2eEnv, *DaemonClient, *fakeMounter, *fakeMounter, func()) {
+	mounter := newFakeMounter()
+	e, cleanupEnv := newE2EEnv(t, WithMounter(func() (Mounter, error) { return mounter, nil }))
+
+	fallbackMounter := newFakeMounter()
+	fallback, err := NewFlexVolume(WithMounter(func() (Mounter, error) { return fallbackMounter, nil }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	*fallback.cfg = *e.sv.cfg
+
+	origDaemonSocket := daemonSocket
+	daemonSocket = path.Join(e.tmpDir, "daemon.sock")
+	listener, err := listenCSI("unix://" + daemonSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: newDaemon(e.sv)}
+	go server.Serve(listener)
+
+	return e, NewDaemonClient(fallback), mounter, fallbackMounter, func() {
+		server.Close()
+		daemonSocket = origDaemonSocket
+		cleanupEnv()
+	}
+}
+
+func TestDaemonClient(t *testing.T) {
+	e, client, mounter, fallbackMounter, cleanup := newTestDaemon(t)
+	defer cleanup()
+
+	e.api.grant("daemon-token", e2eSecrets...)
+
+	device, err := client.Attach(map[string]interface{}{"name": "vol", tokenOption: "daemon-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device != path.Join(e.tmpDir, "staging", "vol") {
+		t.Errorf("Unexpected device %s", device)
+	}
+	for _, s := range e2eSecrets {
+		if content, err := ioutil.ReadFile(path.Join(device, s.Name)); err != nil || string(content) != s.Value {
+			t.Errorf("Unexpected %s %q: %v", s.Name, content, err)
+		}
+	}
+
+	// The daemon forgets the values of a call once it is done
+	if len(logRedactor.values) != 0 || len(logRedactor.digests) != 0 {
+		t.Errorf("Redaction values kept after the call: %d values, %d digest lengths", len(logRedactor.values), len(logRedactor.digests))
+	}
+
+	target := path.Join(e.tmpDir, "pods", "abc", "volumes", "rancher~secrets", "vol")
+	if err := client.Mount(target, device, map[string]interface{}{"readOnly": "true"}); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := mounter.mounts[target]; !ok || m.options != "bind,ro" {
+		t.Errorf("Unexpected bind mount %+v", m)
+	}
+
+	if err := client.Unmount(target); err != nil {
+		t.Error(err)
+	}
+	if err := client.Detach(device); err != nil {
+		t.Error(err)
+	}
+	if len(mounter.mounts) != 0 {
+		t.Errorf("Mounts left after detach: %v", mounter.mounts)
+	}
+
+	// Errors are those of the daemon, and are not retried in process
+	if _, err := client.Attach(map[string]interface{}{"name": "other", tokenOption: "unknown"}); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Expected the daemon to refuse the token, got %v", err)
+	}
+
+	if len(fallbackMounter.calls) != 0 {
+		t.Errorf("Calls ran in process: %v", fallbackMounter.calls)
+	}
+}
+
+func TestDaemonClientFallback(t *testing.T) {
+	e, client, mounter, fallbackMounter, cleanup := newTestDaemon(t)
+	defer cleanup()
+
+	e.api.grant("daemon-token", e2eSecrets...)
+
+	for _, socket := range []string{path.Join(e.tmpDir, "missing.sock"), ""} {
+		daemonSocket = socket
+		device, err := client.Attach(map[string]interface{}{"name": "vol", tokenOption: "daemon-token"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := fallbackMounter.mounts[device]; !ok {
+			t.Errorf("%s not attached in process", device)
+		}
+		if err := client.Detach(device); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if len(mounter.calls) != 0 {
+		t.Errorf("Calls ran in the daemon: %v", mounter.calls)
+	}
+}
+
+func TestDaemonUnknownCommand(t *testing.T) {
+	_, client, _, _, cleanup := newTestDaemon(t)
+	defer cleanup()
+
+	if _, _, err := client.call(&daemonRequest{Command: "format"}); err == nil {
+		t.Error("Expected unknown command to fail")
+	}
+}
+
+func TestDaemonClientTimeout(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	defer func(origSocket string, origTimeout time.Duration) {
+		daemonSocket, daemonCallTimeout = origSocket, origTimeout
+	}(daemonSocket, daemonCallTimeout)
+	daemonSocket = path.Join(tmpDir, "daemon.sock")
+	daemonCallTimeout = 100 * time.Millisecond
+
+	// A daemon that accepts calls and never answers
+	listener, err := net.Listen("unix", daemonSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	_, forwarded, err := NewDaemonClient(nil).call(&daemonRequest{Command: "attach"})
+	if !forwarded || err == nil || !strings.Contains(err.Error(), "did not answer attach") {
+		t.Errorf("Expected the call to time out, got %v", err)
+	}
+}
+
+func TestDaemonTraceparent(t *testing.T) {
+	e, client, _, _, cleanup := newTestDaemon(t)
+	defer cleanup()
+
+	traceIDs := make(chan string, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := otlpRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		for _, s := range req.ResourceSpans[0].ScopeSpans[0].Spans {
+			traceIDs <- s.TraceID
+		}
+	}))
+	defer collector.Close()
+
+	tr, err := newTracer(collector.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(orig *tracer, origTraceparent string) {
+		activeTracer, callerTraceparent = orig, origTraceparent
+	}(activeTracer, callerTraceparent)
+	activeTracer = tr
+	callerTraceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+	e.api.grant("daemon-token", e2eSecrets...)
+	if _, err := client.Attach(map[string]interface{}{"name": "vol", tokenOption: "daemon-token"}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case id := <-traceIDs:
+		if id != "0af7651916cd43dd8448eb211c80319c" {
+			t.Errorf("Expected the daemon to continue the trace of the caller, got %s", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("No spans exported by the daemon")
+	}
+}
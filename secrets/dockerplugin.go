@@ -0,0 +1,264 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	defaultDockerPluginEndpoint = "unix:///run/docker/plugins/rancher-secrets.sock"
+	dockerPluginContentType     = "application/vnd.docker.plugins.v1.2+json"
+)
+
+// DockerPluginCommand serves backend as a Docker volume plugin, so secrets
+// can be used on plain Docker hosts with --volume-driver rancher-secrets.
+func DockerPluginCommand(backend *FlexVolume) cli.Command {
+	return cli.Command{
+		Name:  "docker-plugin",
+		Usage: "Serve the Docker volume plugin API",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "endpoint", Value: defaultDockerPluginEndpoint, EnvVar: "DOCKER_PLUGIN_ENDPOINT", Usage: "unix socket to serve on"},
+		},
+		Action: func(c *cli.Context) error {
+			listener, err := listenCSI(c.String("endpoint"))
+			if err != nil {
+				return err
+			}
+
+			server := &http.Server{Handler: newDockerPlugin(backend)}
+
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			go func() {
+				<-signals
+				server.Close()
+			}()
+
+			logrus.Infof("Serving Docker volume plugin on %s", c.String("endpoint"))
+			if err := server.Serve(listener); err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+type dockerRequest struct {
+	Name string
+	ID   string
+	Opts map[string]string
+}
+
+type dockerVolume struct {
+	Name       string
+	Mountpoint string                 `json:",omitempty"`
+	CreatedAt  string                 `json:",omitempty"`
+	Status     map[string]interface{} `json:",omitempty"`
+}
+
+type dockerResponse struct {
+	Err          string
+	Mountpoint   string              `json:",omitempty"`
+	Volume       *dockerVolume       `json:",omitempty"`
+	Volumes      []dockerVolume      `json:",omitempty"`
+	Capabilities *dockerCapabilities `json:",omitempty"`
+}
+
+type dockerCapabilities struct {
+	Scope string
+}
+
+// dockerPlugin implements the Docker volume plugin API on a FlexVolume.
+// The options of a volume are only passed to create, so create fetches the
+// secrets like attach, and the staged tmpfs is the mountpoint Docker bind
+// mounts into containers. Calls are serialized like those of the CSI driver.
+type dockerPlugin struct {
+	mu sync.Mutex
+	sv *FlexVolume
+}
+
+func newDockerPlugin(sv *FlexVolume) http.Handler {
+	p := &dockerPlugin{sv: sv}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Plugin.Activate", func(w http.ResponseWriter, r *http.Request) {
+		writeDockerResponse(w, map[string][]string{"Implements": {"VolumeDriver"}})
+	})
+	mux.HandleFunc("/VolumeDriver.Create", p.handle(p.create))
+	mux.HandleFunc("/VolumeDriver.Remove", p.handle(p.remove))
+	mux.HandleFunc("/VolumeDriver.Mount", p.handle(p.path))
+	mux.HandleFunc("/VolumeDriver.Path", p.handle(p.path))
+	mux.HandleFunc("/VolumeDriver.Unmount", p.handle(p.unmount))
+	mux.HandleFunc("/VolumeDriver.Get", p.handle(p.get))
+	mux.HandleFunc("/VolumeDriver.List", p.handle(p.list))
+	mux.HandleFunc("/VolumeDriver.Capabilities", p.handle(p.capabilities))
+	return mux
+}
+
+// handle decodes the request of a volume driver call and reports an error
+// in the Err field of the response, as Docker expects.
+func (p *dockerPlugin) handle(call func(req *dockerRequest) (*dockerResponse, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &dockerRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil && r.ContentLength != 0 {
+			writeDockerResponse(w, &dockerResponse{Err: fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+
+		p.mu.Lock()
+		resp, err := call(req)
+		p.mu.Unlock()
+
+		if err != nil {
+			resp = &dockerResponse{Err: err.Error()}
+		}
+		writeDockerResponse(w, resp)
+	}
+}
+
+func writeDockerResponse(w http.ResponseWriter, resp interface{}) {
+	w.Header().Set("Content-Type", dockerPluginContentType)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logrus.Errorf("Failed to write Docker plugin response: %v", err)
+	}
+}
+
+func (p *dockerPlugin) device(name string) (string, error) {
+	if err := isFileName(name); err != nil || name == "" {
+		return "", fmt.Errorf("Invalid volume name %q", name)
+	}
+	return path.Join(p.sv.config().stagingDir, name), nil
+}
+
+// record is the volume record of name, failing if the volume does not exist
+func (p *dockerPlugin) record(name string) (*volumeRecord, error) {
+	device, err := p.device(name)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := getVolumeRecord(newStateStore(p.sv.config().stateDir), device)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Volume %s not found", name)
+	}
+	return record, err
+}
+
+func (p *dockerPlugin) create(req *dockerRequest) (*dockerResponse, error) {
+	if _, err := p.device(req.Name); err != nil {
+		return nil, err
+	}
+
+	params := map[string]interface{}{}
+	for k, v := range req.Opts {
+		// There is no pod, do not let options pretend to be one
+		if !strings.HasPrefix(k, kubeletPrefix) {
+			params[k] = v
+		}
+	}
+	params["name"] = req.Name
+
+	if _, err := p.sv.Attach(params); err != nil {
+		return nil, err
+	}
+	return &dockerResponse{}, nil
+}
+
+func (p *dockerPlugin) remove(req *dockerRequest) (*dockerResponse, error) {
+	device, err := p.device(req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.sv.Delete(map[string]interface{}{"device": device}); err != nil {
+		return nil, err
+	}
+	return &dockerResponse{}, nil
+}
+
+// path serves mount as well, as Docker bind mounts the staged volume itself
+func (p *dockerPlugin) path(req *dockerRequest) (*dockerResponse, error) {
+	record, err := p.record(req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without its tmpfs, e.g. after a reboot, the mountpoint is an empty
+	// directory on the host disk. The token is spent, so it must be created
+	// again.
+	mounted, err := p.sv.getMounter().Mounted(record.Device)
+	if err != nil {
+		return nil, err
+	}
+	if !mounted {
+		return nil, fmt.Errorf("Volume %s is no longer mounted, remove and create it again", req.Name)
+	}
+
+	return &dockerResponse{Mountpoint: record.Device}, nil
+}
+
+func (p *dockerPlugin) unmount(req *dockerRequest) (*dockerResponse, error) {
+	if _, err := p.record(req.Name); err != nil {
+		return nil, err
+	}
+	return &dockerResponse{}, nil
+}
+
+func (p *dockerPlugin) get(req *dockerRequest) (*dockerResponse, error) {
+	record, err := p.record(req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Status is visible to anyone using the Docker API, leave the hashes out
+	secrets := []map[string]string{}
+	for _, s := range record.Secrets {
+		secrets = append(secrets, map[string]string{"name": s.Name, "mode": s.Mode, "uid": s.UID, "gid": s.GID})
+	}
+
+	volume := dockerVolumeOf(*record)
+	volume.Status = map[string]interface{}{
+		"backend": record.Backend,
+		"secrets": secrets,
+	}
+	return &dockerResponse{Volume: &volume}, nil
+}
+
+func (p *dockerPlugin) list(req *dockerRequest) (*dockerResponse, error) {
+	cfg := p.sv.config()
+	statuses, err := volumeStatuses(cfg.stagingDir, newStateStore(cfg.stateDir), p.sv.getMounter())
+	if err != nil {
+		return nil, err
+	}
+
+	volumes := []dockerVolume{}
+	for _, s := range statuses {
+		if s.Recorded {
+			volumes = append(volumes, dockerVolumeOf(s.volumeRecord))
+		}
+	}
+	return &dockerResponse{Volumes: volumes}, nil
+}
+
+func (p *dockerPlugin) capabilities(req *dockerRequest) (*dockerResponse, error) {
+	return &dockerResponse{Capabilities: &dockerCapabilities{Scope: "local"}}, nil
+}
+
+func dockerVolumeOf(record volumeRecord) dockerVolume {
+	return dockerVolume{
+		Name:       record.Name,
+		Mountpoint: record.Device,
+		CreatedAt:  record.AttachedAt.Format(time.RFC3339),
+	}
+}
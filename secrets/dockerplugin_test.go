@@ -0,0 +1,158 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+)
+
+// newTestDockerPlugin serves the Docker plugin for an e2e env on a socket
+// in its temp dir, returning a client that posts to it like Docker does.
+func newTestDockerPlugin(t *testing.T) (*e2eEnv, *fakeMounter, func(string, interface{}) dockerResponse, func()) {
+	mounter := newFakeMounter()
+	e, cleanupEnv := newE2EEnv(t, WithMounter(func() (Mounter, error) { return mounter, nil }))
+
+	socket := path.Join(e.tmpDir, "plugins", "rancher-secrets.sock")
+	listener, err := listenCSI("unix://" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: newDockerPlugin(e.sv)}
+	go server.Serve(listener)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}}
+
+	call := func(method string, req interface{}) dockerResponse {
+		body, _ := json.Marshal(req)
+		resp, err := client.Post("http://plugin/"+method, dockerPluginContentType, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		result := dockerResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		return result
+	}
+
+	return e, mounter, call, func() {
+		server.Close()
+		cleanupEnv()
+	}
+}
+
+func TestDockerPlugin(t *testing.T) {
+	e, mounter, call, cleanup := newTestDockerPlugin(t)
+	defer cleanup()
+
+	e.api.grant("docker-token", e2eSecrets...)
+
+	if resp := call("VolumeDriver.Capabilities", nil); resp.Capabilities == nil || resp.Capabilities.Scope != "local" {
+		t.Errorf("Unexpected capabilities %+v", resp)
+	}
+
+	create := dockerRequest{Name: "web", Opts: map[string]string{tokenOption: "docker-token", "sizeLimit": "1m"}}
+	if resp := call("VolumeDriver.Create", create); resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+
+	device := path.Join(e.tmpDir, "staging", "web")
+	if _, ok := mounter.mounts[device]; !ok {
+		t.Errorf("%s not mounted by create", device)
+	}
+
+	mount := call("VolumeDriver.Mount", dockerRequest{Name: "web", ID: "c1"})
+	if mount.Err != "" || mount.Mountpoint != device {
+		t.Fatalf("Unexpected mount %+v", mount)
+	}
+	for _, s := range e2eSecrets {
+		if content, err := ioutil.ReadFile(path.Join(mount.Mountpoint, s.Name)); err != nil || string(content) != s.Value {
+			t.Errorf("Unexpected %s %q: %v", s.Name, content, err)
+		}
+	}
+
+	if resp := call("VolumeDriver.Path", dockerRequest{Name: "web"}); resp.Mountpoint != device {
+		t.Errorf("Unexpected path %+v", resp)
+	}
+
+	get := call("VolumeDriver.Get", dockerRequest{Name: "web"})
+	if get.Err != "" || get.Volume == nil || get.Volume.Name != "web" || get.Volume.Mountpoint != device || get.Volume.Status["backend"] != rancherBackend {
+		t.Errorf("Unexpected volume %+v", get)
+	}
+
+	if status, _ := json.Marshal(get.Volume.Status); strings.Contains(string(status), "sha256") || !strings.Contains(string(status), e2eSecrets[0].Name) {
+		t.Errorf("Expected the secrets without hashes in the status: %s", status)
+	}
+
+	// A volume whose tmpfs is gone is not handed out
+	tmpfs := mounter.mounts[device]
+	delete(mounter.mounts, device)
+	if resp := call("VolumeDriver.Mount", dockerRequest{Name: "web", ID: "c2"}); resp.Err == "" {
+		t.Error("Expected mount of a volume without its tmpfs to fail")
+	}
+	if resp := call("VolumeDriver.Path", dockerRequest{Name: "web"}); resp.Err == "" {
+		t.Error("Expected path of a volume without its tmpfs to fail")
+	}
+	mounter.mounts[device] = tmpfs
+
+	list := call("VolumeDriver.List", nil)
+	if len(list.Volumes) != 1 || list.Volumes[0].Name != "web" {
+		t.Errorf("Unexpected volumes %+v", list)
+	}
+
+	if resp := call("VolumeDriver.Unmount", dockerRequest{Name: "web", ID: "c1"}); resp.Err != "" {
+		t.Error(resp.Err)
+	}
+	if resp := call("VolumeDriver.Remove", dockerRequest{Name: "web"}); resp.Err != "" {
+		t.Error(resp.Err)
+	}
+
+	if len(mounter.mounts) != 0 {
+		t.Errorf("Mounts left after remove: %v", mounter.mounts)
+	}
+	if resp := call("VolumeDriver.Get", dockerRequest{Name: "web"}); resp.Err == "" {
+		t.Error("Removed volume still exists")
+	}
+	if resp := call("VolumeDriver.List", nil); len(resp.Volumes) != 0 {
+		t.Errorf("Removed volume still listed %+v", resp)
+	}
+}
+
+func TestDockerPluginErrors(t *testing.T) {
+	_, _, call, cleanup := newTestDockerPlugin(t)
+	defer cleanup()
+
+	if resp := call("Plugin.Activate", nil); resp.Err != "" {
+		t.Error(resp.Err)
+	}
+
+	requests := []struct {
+		method string
+		req    dockerRequest
+	}{
+		{"VolumeDriver.Create", dockerRequest{Name: "../web"}},
+		{"VolumeDriver.Create", dockerRequest{Name: "web"}},
+		{"VolumeDriver.Create", dockerRequest{Name: "web", Opts: map[string]string{tokenOption: "unknown"}}},
+		{"VolumeDriver.Mount", dockerRequest{Name: "missing", ID: "c1"}},
+		{"VolumeDriver.Path", dockerRequest{Name: "missing"}},
+		{"VolumeDriver.Unmount", dockerRequest{Name: "missing", ID: "c1"}},
+		{"VolumeDriver.Get", dockerRequest{Name: ""}},
+	}
+	for _, r := range requests {
+		if resp := call(r.method, r.req); resp.Err == "" {
+			t.Errorf("Expected %s of %+v to fail", r.method, r.req)
+		}
+	}
+}
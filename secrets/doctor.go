@@ -0,0 +1,230 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	kubeletPluginDir = "/usr/libexec/kubernetes/kubelet-plugins/volume/exec"
+	// kubelet runs <vendor>~<driver>/<driver>, as installed by package/run.sh
+	pluginVendorDriver = "rancher~secrets"
+	pluginDriver       = "secrets"
+)
+
+var rancherEnv = []string{"CATTLE_URL", "CATTLE_AGENT_ACCESS_KEY", "CATTLE_AGENT_SECRET_KEY"}
+
+// doctorCheck is a single host prerequisite. run returns a short detail on
+// success and an error describing the failure otherwise.
+type doctorCheck struct {
+	name string
+	hint string
+	run  func() (string, error)
+}
+
+type doctorResult struct {
+	name   string
+	ok     bool
+	detail string
+	hint   string
+}
+
+// DoctorCommand checks the host prerequisites of the driver and prints how
+// to fix the ones that fail.
+func DoctorCommand() cli.Command {
+	return cli.Command{
+		Name:  "doctor",
+		Usage: "Check the host prerequisites of the driver",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "host-key", Value: hostKeyPath, Usage: "RSA host key"},
+			cli.StringFlag{Name: "plugin-dir", Value: kubeletPluginDir, Usage: "kubelet exec volume plugin directory"},
+			cli.BoolFlag{Name: "skip-api", Usage: "do not contact the Rancher API"},
+			cli.BoolFlag{Name: "skip-mount", Usage: "do not try to mount a tmpfs"},
+		},
+		Action: doctor,
+	}
+}
+
+func doctor(c *cli.Context) error {
+	checks := []doctorCheck{
+		hostKeyCheck(c.String("host-key")),
+		envCheck(os.Getenv),
+	}
+	if !c.Bool("skip-api") {
+		checks = append(checks, apiCheck(os.Getenv))
+	}
+	if !c.Bool("skip-mount") {
+		checks = append(checks, tmpfsCheck(hostMounter))
+	}
+	checks = append(checks, pluginPathCheck(c.String("plugin-dir")))
+
+	if failed := printDoctorReport(os.Stdout, runDoctorChecks(checks)); failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d of %d checks failed", failed, len(checks)), 1)
+	}
+	return nil
+}
+
+func runDoctorChecks(checks []doctorCheck) []doctorResult {
+	results := []doctorResult{}
+	for _, check := range checks {
+		detail, err := check.run()
+		result := doctorResult{
+			name:   check.name,
+			ok:     err == nil,
+			detail: detail,
+		}
+		if err != nil {
+			result.detail = err.Error()
+			result.hint = check.hint
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// printDoctorReport prints one line per check and returns the number of
+// failed checks.
+func printDoctorReport(out io.Writer, results []doctorResult) int {
+	failed := 0
+	for _, r := range results {
+		status := "PASS"
+		if !r.ok {
+			status = "FAIL"
+			failed++
+		}
+
+		fmt.Fprintf(out, "[%s] %s: %s\n", status, r.name, r.detail)
+		if r.hint != "" {
+			fmt.Fprintf(out, "       %s\n", r.hint)
+		}
+	}
+	return failed
+}
+
+func hostKeyCheck(keyPath string) doctorCheck {
+	return doctorCheck{
+		name: "host key",
+		hint: fmt.Sprintf("%s must be a readable PEM encoded PKCS#1 RSA private key, as written by the Rancher agent", keyPath),
+		run: func() (string, error) {
+			key, err := loadPrivateKeyFromFile(keyPath)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s, %d bit RSA", keyPath, key.N.BitLen()), nil
+		},
+	}
+}
+
+func envCheck(getenv func(string) string) doctorCheck {
+	return doctorCheck{
+		name: "environment",
+		hint: "The driver inherits these from the Rancher agent, run it from the agent container or export them",
+		run: func() (string, error) {
+			missing := []string{}
+			for _, name := range rancherEnv {
+				if getenv(name) == "" {
+					missing = append(missing, name)
+				}
+			}
+			if len(missing) > 0 {
+				return "", fmt.Errorf("%s not set", strings.Join(missing, ", "))
+			}
+			return strings.Join(rancherEnv, ", ") + " set", nil
+		},
+	}
+}
+
+func apiCheck(getenv func(string) string) doctorCheck {
+	return doctorCheck{
+		name: "rancher api",
+		hint: "Check that CATTLE_URL is reachable from this host and the agent keys are valid",
+		run: func() (string, error) {
+			url := getenv("CATTLE_URL")
+			if url == "" {
+				return "", errors.New("CATTLE_URL not set")
+			}
+			url = strings.Replace(url, "v1", "v2-beta", 1)
+
+			client, err := newRancherClient()
+			if err != nil {
+				return "", err
+			}
+
+			req, err := http.NewRequest("GET", url, nil)
+			if err != nil {
+				return "", err
+			}
+			req.SetBasicAuth(getenv("CATTLE_AGENT_ACCESS_KEY"), getenv("CATTLE_AGENT_SECRET_KEY"))
+
+			resp, err := client.Do(req)
+			if err != nil {
+				return "", err
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				return "", fmt.Errorf("%s returned %s", url, resp.Status)
+			}
+			return url + " reachable", nil
+		},
+	}
+}
+
+func tmpfsCheck(mounter Mounter) doctorCheck {
+	return doctorCheck{
+		name: "tmpfs mount",
+		hint: "The driver must run as root with CAP_SYS_ADMIN in the host mount namespace",
+		run: func() (string, error) {
+			dir, err := ioutil.TempDir("", "secrets-flexvol-doctor-")
+			if err != nil {
+				return "", err
+			}
+			defer os.RemoveAll(dir)
+
+			if err := mounter.Mount(tmpfsMedium, dir, tmpfsMedium, "size=1m,"+strings.Join(enforcedMountOpts, ",")); err != nil {
+				return "", err
+			}
+			if err := mounter.Unmount(dir); err != nil {
+				return "", err
+			}
+			return "mounted and unmounted a tmpfs", nil
+		},
+	}
+}
+
+func pluginPathCheck(pluginDir string) doctorCheck {
+	want := path.Join(pluginDir, pluginVendorDriver, pluginDriver)
+	return doctorCheck{
+		name: "kubelet plugin",
+		hint: fmt.Sprintf("Install the driver as %s, kubelet requires the <vendor>~<driver>/<driver> layout (see package/run.sh)", want),
+		run: func() (string, error) {
+			fi, err := os.Stat(want)
+			if err == nil {
+				if !fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0 {
+					return "", fmt.Errorf("%s is not an executable file", want)
+				}
+				return want, nil
+			}
+			if !os.IsNotExist(err) {
+				return "", err
+			}
+
+			// Point out likely misnamed installs
+			files, _ := ioutil.ReadDir(pluginDir)
+			for _, f := range files {
+				if strings.Contains(f.Name(), pluginDriver) {
+					return "", fmt.Errorf("%s not found, but found %s", want, path.Join(pluginDir, f.Name()))
+				}
+			}
+			return "", fmt.Errorf("%s not found", want)
+		},
+	}
+}
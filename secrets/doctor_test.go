@@ -0,0 +1,57 @@
+package secrets
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestDoctorChecks(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyPath := path.Join(tmpDir, "host.key")
+	ioutil.WriteFile(keyPath, []byte(insecureKey), 0600)
+
+	badKeyPath := path.Join(tmpDir, "bad.key")
+	ioutil.WriteFile(badKeyPath, []byte("not a key"), 0600)
+
+	pluginDir := path.Join(tmpDir, "exec")
+	os.MkdirAll(path.Join(pluginDir, "rancher-secrets"), 0755)
+
+	env := map[string]string{"CATTLE_URL": "http://rancher/v1"}
+
+	results := runDoctorChecks([]doctorCheck{
+		hostKeyCheck(keyPath),
+		hostKeyCheck(badKeyPath),
+		envCheck(func(name string) string { return env[name] }),
+		pluginPathCheck(pluginDir),
+	})
+
+	out := &bytes.Buffer{}
+	if failed := printDoctorReport(out, results); failed != 3 {
+		t.Errorf("Expected 3 failed checks, got %d:\n%s", failed, out.String())
+	}
+
+	if !results[0].ok || results[0].hint != "" {
+		t.Errorf("Expected valid key to pass: %v", results[0])
+	}
+	if !strings.Contains(results[2].detail, "CATTLE_AGENT_ACCESS_KEY, CATTLE_AGENT_SECRET_KEY") {
+		t.Errorf("Missing env vars not reported: %s", results[2].detail)
+	}
+	if !strings.Contains(results[3].detail, "rancher-secrets") {
+		t.Errorf("Misnamed plugin dir not reported: %s", results[3].detail)
+	}
+
+	os.MkdirAll(path.Join(pluginDir, pluginVendorDriver), 0755)
+	ioutil.WriteFile(path.Join(pluginDir, pluginVendorDriver, pluginDriver), []byte{}, 0755)
+	if _, err := pluginPathCheck(pluginDir).run(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,236 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+
+	flexvol "github.com/rancher/rancher-flexvol"
+)
+
+// e2eNamespaceEnv is set when the test binary runs itself inside a user and
+// mount namespace, where it can mount tmpfs for real.
+const e2eNamespaceEnv = "SECRETS_FLEXVOL_E2E_NAMESPACE"
+
+var e2eSecrets = []fakeSecret{
+	{Name: "db_password", Value: "hunter2", Mode: "400"},
+	{Name: "api_key", Value: "k3y\x00with\nbinary"},
+}
+
+// e2eEnv is a driver wired to the fake secrets API with every host path below
+// a temp dir.
+type e2eEnv struct {
+	api    *fakeSecretsAPI
+	sv     *FlexVolume
+	tmpDir string
+}
+
+func newE2EEnv(t testing.TB, opts ...FlexVolumeOption) (*e2eEnv, func()) {
+	tmpDir, err := ioutil.TempDir("", "e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := newFakeSecretsAPI(t)
+	restoreEnv := api.setEnv()
+	origAuditLogPath := auditLogPath
+	auditLogPath = path.Join(tmpDir, "audit.log")
+
+	sv, err := NewFlexVolume(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sv.cfg.keyPath = path.Join(tmpDir, "host.key")
+	sv.cfg.fileSecretsRoot = path.Join(tmpDir, "secrets")
+	sv.cfg.stateDir = path.Join(tmpDir, "state")
+	sv.cfg.stagingDir = path.Join(tmpDir, "staging")
+	api.writeHostKey(t, sv.cfg.keyPath)
+
+	return &e2eEnv{api: api, sv: sv, tmpDir: tmpDir}, func() {
+		auditLogPath = origAuditLogPath
+		restoreEnv()
+		api.Close()
+		os.RemoveAll(tmpDir)
+	}
+}
+
+// run invokes the driver CLI the way kubelet does, and
+// decodes what it prints.
+func (e *e2eEnv) run(t *testing.T, args ...string) flexvol.DriverOutput {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+	NewApp(e.sv).Run(append([]string{"secrets-flexvol"}, args...))
+	os.Stdout = stdout
+	w.Close()
+
+	out := &bytes.Buffer{}
+	io.Copy(out, r)
+	r.Close()
+
+	result := flexvol.DriverOutput{}
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatalf("%s printed %q: %v", args[0], out, err)
+	}
+	return result
+}
+
+func (e *e2eEnv) mustRun(t *testing.T, args ...string) flexvol.DriverOutput {
+	result := e.run(t, args...)
+	if result.Status != flexvol.StatusSuccess {
+		t.Fatalf("%s failed: %s", args[0], result.Message)
+	}
+	return result
+}
+
+// lifecycle drives a volume through attach, mount, unmount and detach. The
+// secrets are checked through the bind mount when bind is set, and on the
+// device otherwise.
+func (e *e2eEnv) lifecycle(t *testing.T, mounted func(string) bool, bind bool) {
+	e.api.grant("e2e-token", e2eSecrets...)
+
+	params, _ := json.Marshal(map[string]interface{}{
+		"name":                     "vol",
+		"io.rancher.secrets.token": "e2e-token",
+	})
+	device := e.mustRun(t, "attach", string(params)).Device
+	if !mounted(device) {
+		t.Fatalf("%s is not mounted after attach", device)
+	}
+
+	target := path.Join(e.tmpDir, "pods", "e2e", "volumes", "rancher~secrets", "vol")
+	if err := os.MkdirAll(target, 0750); err != nil {
+		t.Fatal(err)
+	}
+	e.mustRun(t, "mount", target, device, `{"readOnly":"true"}`)
+	if !mounted(target) {
+		t.Fatalf("%s is not mounted after mount", target)
+	}
+
+	dir := device
+	if bind {
+		dir = target
+	}
+	for _, s := range e2eSecrets {
+		content, err := ioutil.ReadFile(path.Join(dir, s.Name))
+		if err != nil || string(content) != s.Value {
+			t.Errorf("Unexpected %s %q: %v", s.Name, content, err)
+		}
+	}
+	if fi, err := os.Stat(path.Join(dir, "db_password")); err != nil || fi.Mode().Perm() != 0400 {
+		t.Errorf("Expected db_password mode 0400: %v", err)
+	}
+
+	e.mustRun(t, "unmount", target)
+	if mounted(target) {
+		t.Errorf("%s is mounted after unmount", target)
+	}
+
+	e.mustRun(t, "detach", device)
+	if mounted(device) {
+		t.Errorf("%s is mounted after detach", device)
+	}
+	if _, err := os.Stat(device); !os.IsNotExist(err) {
+		t.Errorf("%s not removed by detach", device)
+	}
+
+	audit, _ := ioutil.ReadFile(auditLogPath)
+	if n := strings.Count(string(audit), `"outcome":"success"`); n != 4 {
+		t.Errorf("Expected 4 successful audit events, got %d:\n%s", n, audit)
+	}
+	for _, s := range e2eSecrets {
+		if strings.Contains(string(audit), s.Value) {
+			t.Errorf("Audit log contains the value of %s", s.Name)
+		}
+	}
+}
+
+func TestE2E(t *testing.T) {
+	mounter := newFakeMounter()
+	e, cleanup := newE2EEnv(t, WithMounter(func() (Mounter, error) { return mounter, nil }))
+	defer cleanup()
+
+	e.lifecycle(t, func(dir string) bool {
+		_, ok := mounter.mounts[dir]
+		return ok
+	}, false)
+
+	if n := e.api.requestCount(); n != 1 {
+		t.Errorf("Expected 1 request to the secrets API, got %d", n)
+	}
+}
+
+func TestE2EUnauthorized(t *testing.T) {
+	e, cleanup := newE2EEnv(t, WithMounter(func() (Mounter, error) { return newFakeMounter(), nil }))
+	defer cleanup()
+
+	params, _ := json.Marshal(map[string]interface{}{
+		"name":                     "vol",
+		"io.rancher.secrets.token": "unknown-token",
+	})
+	result := e.run(t, "attach", string(params))
+	if result.Status != flexvol.StatusFailure || !strings.Contains(result.Message, "403") {
+		t.Errorf("Expected attach with an unknown token to be forbidden, got %+v", result)
+	}
+}
+
+// TestE2ENamespace runs the lifecycle against real tmpfs and bind mounts. The
+// test binary runs itself in a new user and mount namespace, so no privileges
+// are needed and no mount leaks to the host.
+func TestE2ENamespace(t *testing.T) {
+	if os.Getenv(e2eNamespaceEnv) == "" {
+		runInNamespace(t)
+		return
+	}
+
+	// Keep mounts made by the test out of the parent namespace
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	e, cleanup := newE2EEnv(t)
+	defer cleanup()
+
+	e.lifecycle(t, func(dir string) bool {
+		mounted, err := hostMounter.Mounted(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mounted
+	}, true)
+}
+
+func runInNamespace(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestE2ENamespace$", "-test.v")
+	cmd.Env = append(os.Environ(), e2eNamespaceEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Start(); err != nil {
+		t.Skipf("User namespaces are not available: %v", err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("Namespaced run failed: %v\n%s", err, out)
+	}
+	if !strings.Contains(out.String(), "--- PASS: TestE2ENamespace") {
+		t.Fatalf("Namespaced run did not pass:\n%s", out)
+	}
+}
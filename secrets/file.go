@@ -0,0 +1,136 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var encryptedFileExtensions = []string{".age", ".gpg", ".pgp", ".asc"}
+
+// NewFileSecretGetter returns a SecretGetter that reads encrypted files from
+// a directory below rootDir. No network calls are made.
+func NewFileSecretGetter(rootDir string, params *options) (SecretGetter, error) {
+	return &fileSecretGetter{
+		dir: securePath(rootDir, params.SecretsPath),
+	}, nil
+}
+
+func (fsg fileSecretGetter) GetSecrets(params *options) ([]secret, error) {
+	returnSecrets := []secret{}
+
+	files, err := ioutil.ReadDir(fsg.dir)
+	if err != nil {
+		return returnSecrets, err
+	}
+
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		name, ok := trimEncryptedExtension(fi.Name())
+		if !ok {
+			logrus.Debugf("Skipping %s, not an encrypted file", fi.Name())
+			continue
+		}
+
+		content, err := ioutil.ReadFile(path.Join(fsg.dir, fi.Name()))
+		if err != nil {
+			return returnSecrets, err
+		}
+
+		returnSecrets = append(returnSecrets, secret{
+			Name:       name,
+			RewrapText: base64.StdEncoding.EncodeToString(content),
+		})
+	}
+
+	return returnSecrets, nil
+}
+
+// NewFileSecretWriter returns a SecretWriter for secrets whose RewrapText is
+// an entire encrypted file understood by the decryptor.
+func NewFileSecretWriter(decryptor Decryptor) (SecretWriter, error) {
+	return &fileSecretWriter{
+		decryptor: decryptor,
+	}, nil
+}
+
+func (fsw fileSecretWriter) Write(secrets []secret, dstDir string) error {
+	for _, secret := range secrets {
+		clearText, err := fsw.decryptor.Decrypt(secret.RewrapText)
+		if err != nil {
+			zero(clearText)
+			return err
+		}
+
+		err = secret.writeFile(dstDir, clearText)
+		zero(clearText)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewHostFileDecryptor returns a Decryptor that picks age or OpenPGP based on
+// the content it is given, using whichever host identities are available.
+func NewHostFileDecryptor(ageIdentityPath, rsaKeyPath, keyringPath string) (Decryptor, error) {
+	hfd := hostFileDecryptor{}
+
+	ageDecryptor, ageErr := NewAgeDecryptor(ageIdentityPath, rsaKeyPath)
+	if ageErr == nil {
+		hfd.age = ageDecryptor
+	}
+
+	pgpDecryptor, pgpErr := NewOpenPGPDecryptor(keyringPath)
+	if pgpErr == nil {
+		hfd.openPGP = pgpDecryptor
+	}
+
+	if hfd.age == nil && hfd.openPGP == nil {
+		logrus.Errorf("age: %v, OpenPGP: %v", ageErr, pgpErr)
+		return nil, errors.New("No host identity available to decrypt files")
+	}
+
+	return hfd, nil
+}
+
+// Decrypt implements the Decryptor interface
+func (hfd hostFileDecryptor) Decrypt(cipherText string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(cipherText)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if isAge(data) {
+		if hfd.age == nil {
+			return []byte{}, errors.New("age encrypted file but no age identity on host")
+		}
+		return hfd.age.Decrypt(cipherText)
+	}
+
+	if hfd.openPGP == nil {
+		return []byte{}, errors.New("OpenPGP encrypted file but no OpenPGP keyring on host")
+	}
+	return hfd.openPGP.Decrypt(cipherText)
+}
+
+func trimEncryptedExtension(name string) (string, bool) {
+	for _, ext := range encryptedFileExtensions {
+		if strings.HasSuffix(name, ext) && len(name) > len(ext) {
+			return strings.TrimSuffix(name, ext), true
+		}
+	}
+	return name, false
+}
+
+// securePath joins rel onto root without letting it escape root.
+func securePath(root, rel string) string {
+	return path.Join(root, path.Clean("/"+rel))
+}
@@ -0,0 +1,148 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func writeAgeFile(t *testing.T, file string, armored bool, content string, recipients ...age.Recipient) {
+	buf := &bytes.Buffer{}
+
+	var dst io.Writer = buf
+	var armorWriter io.WriteCloser
+	if armored {
+		armorWriter = armor.NewWriter(buf)
+		dst = armorWriter
+	}
+
+	w, err := age.Encrypt(dst, recipients...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, content)
+	w.Close()
+
+	if armorWriter != nil {
+		armorWriter.Close()
+	}
+
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileBackend(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "file-backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcDir := path.Join(tmpDir, "src", "app")
+	dstDir := path.Join(tmpDir, "dst")
+	for _, dir := range []string{srcDir, dstDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// age identity file
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityPath := path.Join(tmpDir, "host.age")
+	ioutil.WriteFile(identityPath, []byte(identity.String()+"\n"), 0600)
+	writeAgeFile(t, path.Join(srcDir, "x25519.age"), false, "hello", identity.Recipient())
+
+	// RSA host key used as an age ssh-rsa identity
+	keyPath := path.Join(tmpDir, "host.key")
+	ioutil.WriteFile(keyPath, []byte(insecureKey), 0600)
+	rsaKey, _ := loadPrivateKeyFromString(insecureKey)
+	rsaIdentity, err := agessh.NewRSAIdentity(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAgeFile(t, path.Join(srcDir, "hostkey.age"), true, "world", rsaIdentity.Recipient())
+
+	// OpenPGP keyring
+	pgpConfig := &packet.Config{DefaultHash: crypto.SHA256}
+	entity, err := openpgp.NewEntity("host", "", "host@example.com", pgpConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := &bytes.Buffer{}
+	entity.SerializePrivate(keyring, nil)
+	keyringPath := path.Join(tmpDir, "host.gpg")
+	ioutil.WriteFile(keyringPath, keyring.Bytes(), 0600)
+
+	msg := &bytes.Buffer{}
+	w, err := openpgp.Encrypt(msg, []*openpgp.Entity{entity}, nil, nil, pgpConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "pgp")
+	w.Close()
+	ioutil.WriteFile(path.Join(srcDir, "openpgp.gpg"), msg.Bytes(), 0600)
+
+	// Not encrypted, should be ignored
+	ioutil.WriteFile(path.Join(srcDir, "README"), []byte("ignore me"), 0644)
+
+	params := &options{Backend: fileBackend, SecretsPath: "../../src/app"}
+	getter, err := NewFileSecretGetter(path.Join(tmpDir, "src"), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := getter.GetSecrets(params); err == nil {
+		t.Error("Expected secretsPath to be confined to the root directory")
+	}
+
+	params.SecretsPath = "app"
+	getter, _ = NewFileSecretGetter(path.Join(tmpDir, "src"), params)
+	secrets, err := getter.GetSecrets(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(secrets) != 3 {
+		t.Fatalf("Expected 3 secrets, got %d", len(secrets))
+	}
+
+	decryptor, err := NewHostFileDecryptor(identityPath, keyPath, keyringPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sw, _ := NewFileSecretWriter(decryptor)
+	if err := sw.Write(secrets, dstDir); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"x25519":  "hello",
+		"hostkey": "world",
+		"openpgp": "pgp",
+	}
+	for name, value := range expected {
+		content, err := ioutil.ReadFile(path.Join(dstDir, name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(content) != value {
+			t.Errorf("Contents of file %s not equal. %s != %s", name, value, string(content))
+		}
+	}
+}
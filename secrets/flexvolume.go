@@ -0,0 +1,150 @@
+package secrets
+
+// SecretGetterFactory returns the SecretGetter for a volume
+type SecretGetterFactory func(options *Options) (SecretGetter, error)
+
+// DecryptorFactory returns the Decryptor for a volume
+type DecryptorFactory func(options *Options) (Decryptor, error)
+
+// SecretWriterFactory returns the SecretWriter for a volume, using the
+// Decryptor returned by the DecryptorFactory.
+type SecretWriterFactory func(decryptor Decryptor) (SecretWriter, error)
+
+// MounterFactory returns the Mounter of a FlexVolume
+type MounterFactory func() (Mounter, error)
+
+// FlexVolumeOption configures a FlexVolume
+type FlexVolumeOption func(*flexVolumeConfig)
+
+type flexVolumeConfig struct {
+	newGetter    SecretGetterFactory
+	newDecryptor DecryptorFactory
+	newWriter    SecretWriterFactory
+	newMounter   MounterFactory
+}
+
+// WithSecretGetter replaces the getter of the volume backend
+func WithSecretGetter(f SecretGetterFactory) FlexVolumeOption {
+	return func(c *flexVolumeConfig) {
+		c.newGetter = f
+	}
+}
+
+// WithDecryptor replaces the decryptor of the volume backend
+func WithDecryptor(f DecryptorFactory) FlexVolumeOption {
+	return func(c *flexVolumeConfig) {
+		c.newDecryptor = f
+	}
+}
+
+// WithSecretWriter replaces the writer of the volume backend
+func WithSecretWriter(f SecretWriterFactory) FlexVolumeOption {
+	return func(c *flexVolumeConfig) {
+		c.newWriter = f
+	}
+}
+
+// WithMounter replaces the host mounter
+func WithMounter(f MounterFactory) FlexVolumeOption {
+	return func(c *flexVolumeConfig) {
+		c.newMounter = f
+	}
+}
+
+// NewHostMounter returns the Mounter that mounts on the host
+func NewHostMounter() (Mounter, error) {
+	return hostMounter, nil
+}
+
+// NewFlexVolume returns a FlexVolume. Without options it selects the backend
+// of each volume from its options and mounts on the host. Once any of
+// the getter, decryptor or writer is given, all volumes use them, and the
+// Rancher getter, host key decryptor and Rancher writer for those not given.
+// Volumes selecting another backend are then refused.
+func NewFlexVolume(opts ...FlexVolumeOption) (*FlexVolume, error) {
+	c := &flexVolumeConfig{
+		newMounter: NewHostMounter,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	mounter, err := c.newMounter()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := defaultHostConfig()
+	return &FlexVolume{
+		newGetter:    c.newGetter,
+		newDecryptor: c.newDecryptor,
+		newWriter:    c.newWriter,
+		mounter:      mounter,
+		cfg:          &cfg,
+	}, nil
+}
+
+func (sv *FlexVolume) getMounter() Mounter {
+	if sv.mounter == nil {
+		return hostMounter
+	}
+	return sv.mounter
+}
+
+func (sv *FlexVolume) config() hostConfig {
+	if sv.cfg == nil {
+		return defaultHostConfig()
+	}
+	return *sv.cfg
+}
+
+// secretBackend returns the getter and writer for a volume
+func (sv *FlexVolume) secretBackend(options *options, cfg hostConfig) (SecretGetter, SecretWriter, error) {
+	if sv.newGetter == nil && sv.newDecryptor == nil && sv.newWriter == nil {
+		return newSecretBackend(options, cfg)
+	}
+
+	// The given getter, decryptor or writer stand in for the Rancher backend
+	if options.Backend != "" && options.Backend != rancherBackend {
+		return nil, nil, &OptionError{
+			Option: "backend",
+			Value:  options.Backend,
+			Reason: "this driver only serves the Rancher backend with its own getter, decryptor or writer",
+		}
+	}
+
+	newGetter := sv.newGetter
+	if newGetter == nil {
+		newGetter = NewRancherSecretGetter
+	}
+
+	newDecryptor := sv.newDecryptor
+	if newDecryptor == nil {
+		newDecryptor = func(*Options) (Decryptor, error) {
+			return NewRSADecryptor(cfg.keyPath)
+		}
+	}
+
+	newWriter := sv.newWriter
+	if newWriter == nil {
+		newWriter = NewRSASecretFileWriter
+	}
+
+	secretGetter, err := newGetter(options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	decryptor, err := newDecryptor(options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	backend := options.Backend
+	if backend == "" {
+		backend = rancherBackend
+	}
+
+	secretWriter, err := newWriter(instrumentDecryptor(decryptor, backend))
+	return secretGetter, secretWriter, err
+}
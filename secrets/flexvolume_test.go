@@ -0,0 +1,71 @@
+package secrets
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestNewFlexVolumeAttach(t *testing.T) {
+	defer func(orig string) { auditLogPath = orig }(auditLogPath)
+
+	tmpDir, err := ioutil.TempDir("", "flexvolume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	auditLogPath = path.Join(tmpDir, "audit.log")
+
+	mounter := newFakeMounter()
+	sv, err := NewFlexVolume(
+		WithSecretGetter(func(*Options) (SecretGetter, error) { return tGet, nil }),
+		WithDecryptor(func(*Options) (Decryptor, error) { return testDecryptor{}, nil }),
+		WithMounter(func() (Mounter, error) { return mounter, nil }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sv.cfg.stateDir = path.Join(tmpDir, "state")
+	sv.cfg.stagingDir = path.Join(tmpDir, "staging")
+
+	device, err := sv.Attach(map[string]interface{}{"name": "vol", tokenOption: "onetime"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := mounter.mounts[device]; !ok {
+		t.Errorf("Expected %s to be mounted", device)
+	}
+	for name, value := range expectedValues {
+		if content, err := ioutil.ReadFile(path.Join(device, name)); err != nil || string(content) != value {
+			t.Errorf("Unexpected %s %q: %v", name, content, err)
+		}
+	}
+}
+
+func TestNewFlexVolumeErrors(t *testing.T) {
+	mounterErr := errors.New("no mounter")
+	if _, err := NewFlexVolume(WithMounter(func() (Mounter, error) { return nil, mounterErr })); err != mounterErr {
+		t.Errorf("Expected %v, got %v", mounterErr, err)
+	}
+
+	writerErr := errors.New("no writer")
+	sv, err := NewFlexVolume(
+		WithSecretGetter(func(*Options) (SecretGetter, error) { return tGet, nil }),
+		WithDecryptor(func(*Options) (Decryptor, error) { return testDecryptor{}, nil }),
+		WithSecretWriter(func(Decryptor) (SecretWriter, error) { return nil, writerErr }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sv.secretBackend(&options{}, sv.config()); err != writerErr {
+		t.Errorf("Expected %v, got %v", writerErr, err)
+	}
+
+	if _, _, err := sv.secretBackend(&options{Backend: fileBackend}, sv.config()); err == nil || !strings.Contains(err.Error(), `"backend"`) {
+		t.Errorf("Expected the file backend to be refused, got %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package secrets
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -15,6 +16,10 @@ import (
 
 // NewRancherSecretGetter returns a new rancherSecretGetter
 func NewRancherSecretGetter(params *options) (SecretGetter, error) {
+	if params.Token == nil {
+		return &rancherSecretGetter{}, errors.New("No token passed")
+	}
+
 	client, err := newRancherClient()
 	if err != nil {
 		return &rancherSecretGetter{}, err
@@ -43,13 +48,24 @@ func (rsg rancherSecretGetter) GetSecrets(params *options) ([]secret, error) {
 	req.Header.Add("Content-Type", "application/x-api-secrets-token")
 	req.SetBasicAuth(rsg.user, rsg.password)
 
+	span := startSpanIn(params.span, "POST /secrets", spanKindClient)
+	span.setAttribute("http.url", reqURL)
+	if tp := span.traceparent(); tp != "" {
+		req.Header.Set(traceparentHeader, tp)
+	}
+
 	resp, err := rsg.client.Do(req)
+	span.finish(err)
 	if err != nil {
-		logrus.Errorf("Response code: %s", resp.Status)
-		return returnSecrets, err
+		logrus.Errorf("Request to %s failed: %v", reqURL, err)
+		return returnSecrets, unavailableError{err}
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode >= 500 {
+		return returnSecrets, unavailableError{fmt.Errorf("Unsuccessful request: %s", resp.Status)}
+	}
+
 	if resp.StatusCode != 200 {
 		return returnSecrets, fmt.Errorf("Unsuccessful request: %s", resp.Status)
 	}
@@ -64,10 +80,12 @@ func (rsg rancherSecretGetter) GetSecrets(params *options) ([]secret, error) {
 	return returnSecrets, err
 }
 
-func newRancherClient() (*http.Client, error) {
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
+// rancherClient is shared by all getters, so the daemon keeps its
+// connections to Rancher open between calls.
+var rancherClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
 
-	return client, nil
+func newRancherClient() (*http.Client, error) {
+	return rancherClient, nil
 }
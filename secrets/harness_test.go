@@ -0,0 +1,235 @@
+package secrets
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/rancher/secrets-api/pkg/aesutils"
+)
+
+const (
+	fakeAccessKey = "agent-access-key"
+	fakeSecretKey = "agent-secret-key"
+)
+
+// fakeSecret is a secret as it is stored by the Rancher secrets API
+type fakeSecret struct {
+	Name  string
+	Value string
+	UID   string
+	GID   string
+	Mode  string
+}
+
+// fakeSecretsAPI serves POST /v2-beta/secrets like Rancher does: the body is
+// a volume token and the response lists the secrets granted to it, each
+// freshly rewrapped for the host key.
+type fakeSecretsAPI struct {
+	*httptest.Server
+	hostKey *rsa.PrivateKey
+
+	mu       sync.Mutex
+	tokens   map[string][]fakeSecret
+	requests int
+}
+
+func newFakeSecretsAPI(t testing.TB) *fakeSecretsAPI {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := &fakeSecretsAPI{
+		hostKey: hostKey,
+		tokens:  map[string][]fakeSecret{},
+	}
+	api.Server = httptest.NewServer(http.HandlerFunc(api.serveSecrets))
+	return api
+}
+
+// grant makes secrets available to token
+func (a *fakeSecretsAPI) grant(token string, secrets ...fakeSecret) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.tokens[token] = append(a.tokens[token], secrets...)
+}
+
+func (a *fakeSecretsAPI) requestCount() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.requests
+}
+
+func (a *fakeSecretsAPI) serveSecrets(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	a.requests++
+	a.mu.Unlock()
+
+	if r.Method != "POST" || r.URL.Path != "/v2-beta/secrets" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if user, password, ok := r.BasicAuth(); !ok || user != fakeAccessKey || password != fakeSecretKey {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/x-api-secrets-token" {
+		http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	token, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.mu.Lock()
+	granted, ok := a.tokens[string(token)]
+	a.mu.Unlock()
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	secrets := []secret{}
+	for _, s := range granted {
+		rewrap, err := newRewrap(&a.hostKey.PublicKey, []byte(s.Value))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		secrets = append(secrets, secret{
+			Name:       s.Name,
+			UID:        s.UID,
+			GID:        s.GID,
+			Mode:       s.Mode,
+			RewrapText: rewrap,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(secrets)
+}
+
+// setEnv points the Rancher getter at the fake API, returning a func that
+// restores the environment.
+func (a *fakeSecretsAPI) setEnv() func() {
+	vars := map[string]string{
+		"CATTLE_URL":              a.URL + "/v1",
+		"CATTLE_AGENT_ACCESS_KEY": fakeAccessKey,
+		"CATTLE_AGENT_SECRET_KEY": fakeSecretKey,
+	}
+
+	restore := map[string]string{}
+	for k, v := range vars {
+		restore[k] = os.Getenv(k)
+		os.Setenv(k, v)
+	}
+
+	return func() {
+		for k, v := range restore {
+			os.Setenv(k, v)
+		}
+	}
+}
+
+// writeHostKey writes the host key in the PEM format of the host agent
+func (a *fakeSecretsAPI) writeHostKey(t testing.TB, file string) {
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(a.hostKey)}
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newRewrap produces the rewrap text of a secret for the host key the way the
+// secrets API does: the base64 cleartext is sealed with a throwaway AES-GCM
+// key, which is encrypted with RSA-OAEP for the host and used to sign the
+// cleartext.
+func newRewrap(hostKey *rsa.PublicKey, clearText []byte) (string, error) {
+	aesKey := make([]byte, 32)
+	if _, err := rand.Read(aesKey); err != nil {
+		return "", err
+	}
+	key := aesutils.NewAESKeyFromBytes(aesKey)
+
+	encodedClearText := base64.StdEncoding.EncodeToString(clearText)
+
+	encryptedText, err := aesutils.GetEncryptedText(key, encodedClearText, "aes256-gcm96")
+	if err != nil {
+		return "", err
+	}
+
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, hostKey, aesKey, []byte(""))
+	if err != nil {
+		return "", err
+	}
+
+	signature, err := aesutils.Sign(key, encodedClearText)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(encryptedData{
+		EncryptionAlgorithm: "aes256-gcm96",
+		EncryptedText:       encryptedText,
+		EncryptedKey: rsaEncryptedData{
+			EncryptionAlgorithm: "PKCS1_OAEP",
+			EncryptedText:       base64.StdEncoding.EncodeToString(encryptedKey),
+			HashAlgorithm:       "sha256",
+		},
+		Signature: signature,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+func TestNewRewrap(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewrap, err := newRewrap(&hostKey.PublicKey, []byte("s3cr3t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encData, err := getEncryptedData(rewrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aesKey, err := rsaDecryptor{key: hostKey}.Decrypt(encData.EncryptedKey.EncryptedText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clearText, err := getClearText(aesKey, encData.EncryptedText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, _ := base64.StdEncoding.DecodeString(string(clearText)); string(decoded) != "s3cr3t" {
+		t.Errorf("Unexpected cleartext %q", decoded)
+	}
+
+	if ok, err := aesutils.VerifySignature(aesutils.NewAESKeyFromBytes(aesKey), encData.Signature, string(clearText)); !ok || err != nil {
+		t.Errorf("Signature does not verify: %v", err)
+	}
+}
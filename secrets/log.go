@@ -0,0 +1,220 @@
+package secrets
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	defaultLogMaxSize    = 10 * 1024 * 1024
+	defaultLogMaxBackups = 3
+)
+
+// LoggingFlags are the global flags configuring logging. kubelet and Rancher
+// cannot pass flags to the driver, so each has an environment variable,
+// which the driver inherits from its caller.
+func LoggingFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "log-level", Value: "info", EnvVar: "SECRETS_FLEXVOL_LOG_LEVEL", Usage: "debug, info, warning or error"},
+		cli.StringFlag{Name: "log-format", Value: "text", EnvVar: "SECRETS_FLEXVOL_LOG_FORMAT", Usage: "text or json"},
+		cli.StringFlag{Name: "log-file", EnvVar: "SECRETS_FLEXVOL_LOG_FILE", Usage: "log to this file instead of stderr"},
+		cli.IntFlag{Name: "log-max-size", Value: defaultLogMaxSize, EnvVar: "SECRETS_FLEXVOL_LOG_MAX_SIZE", Usage: "rotate the log file at this many bytes"},
+		cli.IntFlag{Name: "log-max-backups", Value: defaultLogMaxBackups, EnvVar: "SECRETS_FLEXVOL_LOG_MAX_BACKUPS", Usage: "rotated log files to keep"},
+	}
+}
+
+// SetupLogging configures the standard logger from LoggingFlags. The
+// redaction hook is always installed, whatever the configuration.
+func SetupLogging(c *cli.Context) error {
+	level, err := logrus.ParseLevel(c.GlobalString("log-level"))
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(level)
+
+	switch c.GlobalString("log-format") {
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	default:
+		return fmt.Errorf("Unknown log format %s", c.GlobalString("log-format"))
+	}
+
+	if file := c.GlobalString("log-file"); file != "" {
+		out, err := newRotatingFile(file, int64(c.GlobalInt("log-max-size")), c.GlobalInt("log-max-backups"))
+		if err != nil {
+			return err
+		}
+		logrus.SetOutput(out)
+	}
+
+	return nil
+}
+
+// callLog carries the fields of a single driver call, and its root span
+type callLog struct {
+	*logrus.Entry
+	command string
+	start   time.Time
+	span    *span
+}
+
+func newCallLog(command string) *callLog {
+	return &callLog{
+		Entry:   logrus.WithField("command", command),
+		command: command,
+		start:   time.Now(),
+		span:    startSpan(command),
+	}
+}
+
+func (l *callLog) withVolume(volume string) *callLog {
+	l.Entry = l.Entry.WithField("volume", volume)
+	l.span.setAttribute("volume", volume)
+	return l
+}
+
+func (l *callLog) withOptions(options *options) *callLog {
+	fields := logrus.Fields{}
+	if options.Name != "" {
+		fields["volume"] = options.Name
+	}
+	if options.PodUID != "" {
+		fields["pod"] = path.Join(options.PodNamespace, options.PodName)
+		fields["podUID"] = options.PodUID
+	}
+
+	backend := options.Backend
+	if backend == "" {
+		backend = rancherBackend
+	}
+	fields["backend"] = backend
+
+	for k, v := range fields {
+		l.span.setAttribute(k, fmt.Sprint(v))
+	}
+	l.Entry = l.Entry.WithFields(fields)
+	return l
+}
+
+// done logs the outcome and duration of the call
+func (l *callLog) done(err error) {
+	d := time.Since(l.start)
+	observeCall(l.command, err, d)
+
+	entry := l.Entry.WithField("duration", d.String())
+	if err != nil {
+		entry.WithField("error", err).Error("Call failed")
+	} else {
+		entry.Info("Call succeeded")
+	}
+
+	l.span.finish(err)
+}
+
+// rotatingFile is an append only log file rotated by size. Every driver call
+// is its own process, so rotation is done under a lock file and a writer
+// whose file was rotated away by another process reopens it.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+}
+
+func newRotatingFile(file string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+
+	r := &rotatingFile{
+		path:       file,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.file = f
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 {
+		if err := r.rotateIfNeeded(int64(len(p))); err != nil {
+			return 0, err
+		}
+	}
+
+	return r.file.Write(p)
+}
+
+func (r *rotatingFile) rotateIfNeeded(n int64) error {
+	lock, err := os.OpenFile(r.path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	current, err := os.Stat(r.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	open, err := r.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if current == nil || !os.SameFile(current, open) {
+		if err := r.open(); err != nil {
+			return err
+		}
+		if current == nil {
+			return nil
+		}
+	}
+
+	if current.Size()+n <= r.maxSize {
+		return nil
+	}
+
+	os.Remove(r.backup(r.maxBackups))
+	for i := r.maxBackups; i > 0; i-- {
+		os.Rename(r.backup(i-1), r.backup(i))
+	}
+
+	return r.open()
+}
+
+func (r *rotatingFile) backup(i int) string {
+	if i == 0 {
+		return r.path
+	}
+	return fmt.Sprintf("%s.%d", r.path, i)
+}
@@ -0,0 +1,79 @@
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestRedactionHook(t *testing.T) {
+	r := newRedactor()
+	r.addValue("tok%22en-value")
+	r.addValue("short")
+	r.addSecrets([]secret{{Name: "a", RewrapText: "eyJlbmNyeXB0ZWRUZXh0Ijoi"}})
+
+	clearText := []byte("hunter2-password")
+	r.addClearText(clearText)
+	zero(clearText)
+
+	out := &bytes.Buffer{}
+	logger := logrus.New()
+	logger.Out = out
+	logger.Formatter = &logrus.JSONFormatter{}
+	logger.Hooks.Add(redactionHook{r})
+
+	entry := logger.WithFields(logrus.Fields{
+		"volume":                   "vol",
+		"error":                    errors.New("bad value hunter2-password"),
+		"io.rancher.secrets.token": "anything",
+	})
+	entry.Errorf("Failed with tok%%22en-value and eyJlbmNyeXB0ZWRUZXh0Ijoi, short")
+
+	for _, leak := range []string{"tok%22en-value", "eyJlbmNyeXB0ZWRUZXh0Ijoi", "hunter2-password", "anything"} {
+		if strings.Contains(out.String(), leak) {
+			t.Errorf("%s leaked into log: %s", leak, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), "short") || !strings.Contains(out.String(), `"volume":"vol"`) {
+		t.Errorf("Unexpected log: %s", out.String())
+	}
+	if entry.Data["io.rancher.secrets.token"] != "anything" {
+		t.Error("Hook modified the fields of the parent entry")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	file := path.Join(tmpDir, "driver.log")
+	w, err := newRotatingFile(file, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for suffix, want := range map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"} {
+		content, err := ioutil.ReadFile(file + suffix)
+		if err != nil || string(content) != want {
+			t.Errorf("Expected %q in %s, got %q: %v", want, file+suffix, content, err)
+		}
+	}
+	if _, err := os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Error("Expected only two backups")
+	}
+}
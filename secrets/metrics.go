@@ -0,0 +1,328 @@
+package secrets
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	metricsStateKind = "metrics"
+	metricsFile      = "secrets_flexvol.prom"
+)
+
+var (
+	// metricsDir is the node-exporter textfile collector directory, empty
+	// disables metrics
+	metricsDir string
+
+	// pendingMetrics collects what this invocation observed until it is
+	// merged into the host wide metrics at the end of the call
+	pendingMetrics = newMetricsState()
+
+	durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+type metricDesc struct {
+	name string
+	help string
+	kind string
+}
+
+var (
+	callsTotal         = metricDesc{"secrets_flexvol_calls_total", "Driver calls by command and outcome.", "counter"}
+	callDuration       = metricDesc{"secrets_flexvol_call_duration_seconds", "Duration of driver calls.", "histogram"}
+	fetchDuration      = metricDesc{"secrets_flexvol_fetch_duration_seconds", "Duration of fetching secrets from a backend.", "histogram"}
+	decryptFailures    = metricDesc{"secrets_flexvol_decrypt_failures_total", "Secrets that failed to decrypt.", "counter"}
+	bytesWritten       = metricDesc{"secrets_flexvol_written_bytes_total", "Bytes of cleartext written to volumes.", "counter"}
+	volumesActive      = metricDesc{"secrets_flexvol_volumes_active", "Volumes currently attached on the host.", "gauge"}
+	metricDescriptions = []metricDesc{callsTotal, callDuration, fetchDuration, decryptFailures, bytesWritten, volumesActive}
+)
+
+// metricsState is the host wide state of all metrics, persisted as JSON in
+// the state store and rendered into the textfile. Series are keyed by their
+// label set in exposition format, e.g. {command="attach",outcome="success"}.
+type metricsState struct {
+	mu         sync.Mutex
+	Counters   map[string]map[string]float64    `json:"counters"`
+	Gauges     map[string]map[string]float64    `json:"gauges"`
+	Histograms map[string]map[string]*histogram `json:"histograms"`
+}
+
+type histogram struct {
+	Buckets []uint64 `json:"buckets"`
+	Count   uint64   `json:"count"`
+	Sum     float64  `json:"sum"`
+}
+
+// MetricsFlags are the global flags configuring metrics
+func MetricsFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "metrics-dir", EnvVar: "SECRETS_FLEXVOL_METRICS_DIR", Usage: "node-exporter textfile collector directory to write metrics to"},
+	}
+}
+
+// SetupMetrics configures metrics from MetricsFlags
+func SetupMetrics(c *cli.Context) error {
+	metricsDir = c.GlobalString("metrics-dir")
+	return nil
+}
+
+func newMetricsState() *metricsState {
+	return &metricsState{
+		Counters:   map[string]map[string]float64{},
+		Gauges:     map[string]map[string]float64{},
+		Histograms: map[string]map[string]*histogram{},
+	}
+}
+
+func labels(pairs ...string) string {
+	parts := []string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", pairs[i], pairs[i+1]))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (m *metricsState) add(desc metricDesc, series string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Counters[desc.name] == nil {
+		m.Counters[desc.name] = map[string]float64{}
+	}
+	m.Counters[desc.name][series] += v
+}
+
+func (m *metricsState) set(desc metricDesc, series string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Gauges[desc.name] == nil {
+		m.Gauges[desc.name] = map[string]float64{}
+	}
+	m.Gauges[desc.name][series] = v
+}
+
+func (m *metricsState) observe(desc metricDesc, series string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Histograms[desc.name] == nil {
+		m.Histograms[desc.name] = map[string]*histogram{}
+	}
+	h := m.Histograms[desc.name][series]
+	if h == nil {
+		h = &histogram{Buckets: make([]uint64, len(durationBuckets))}
+		m.Histograms[desc.name][series] = h
+	}
+
+	for i, le := range durationBuckets {
+		if v <= le {
+			h.Buckets[i]++
+		}
+	}
+	h.Count++
+	h.Sum += v
+}
+
+// merge adds the counters and histograms of other to m and takes its gauges
+func (m *metricsState) merge(other *metricsState) {
+	other.mu.Lock()
+	defer other.mu.Unlock()
+
+	for name, series := range other.Counters {
+		for s, v := range series {
+			m.add(metricDesc{name: name}, s, v)
+		}
+	}
+	for name, series := range other.Gauges {
+		for s, v := range series {
+			m.set(metricDesc{name: name}, s, v)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, series := range other.Histograms {
+		if m.Histograms[name] == nil {
+			m.Histograms[name] = map[string]*histogram{}
+		}
+		for s, h := range series {
+			merged := m.Histograms[name][s]
+			if merged == nil || len(merged.Buckets) != len(h.Buckets) {
+				merged = &histogram{Buckets: make([]uint64, len(h.Buckets))}
+				m.Histograms[name][s] = merged
+			}
+			for i := range h.Buckets {
+				merged.Buckets[i] += h.Buckets[i]
+			}
+			merged.Count += h.Count
+			merged.Sum += h.Sum
+		}
+	}
+}
+
+// write renders m in the Prometheus text exposition format
+func (m *metricsState) write(out io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, desc := range metricDescriptions {
+		var series []string
+		switch desc.kind {
+		case "counter":
+			series = sortedKeys(m.Counters[desc.name])
+		case "gauge":
+			series = sortedKeys(m.Gauges[desc.name])
+		case "histogram":
+			for s := range m.Histograms[desc.name] {
+				series = append(series, s)
+			}
+			sort.Strings(series)
+		}
+		if len(series) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(out, "# HELP %s %s\n", desc.name, desc.help)
+		fmt.Fprintf(out, "# TYPE %s %s\n", desc.name, desc.kind)
+
+		for _, s := range series {
+			switch desc.kind {
+			case "counter":
+				fmt.Fprintf(out, "%s%s %v\n", desc.name, s, m.Counters[desc.name][s])
+			case "gauge":
+				fmt.Fprintf(out, "%s%s %v\n", desc.name, s, m.Gauges[desc.name][s])
+			case "histogram":
+				h := m.Histograms[desc.name][s]
+				for i, le := range durationBuckets {
+					fmt.Fprintf(out, "%s_bucket%s %d\n", desc.name, withLabel(s, "le", fmt.Sprint(le)), h.Buckets[i])
+				}
+				fmt.Fprintf(out, "%s_bucket%s %d\n", desc.name, withLabel(s, "le", "+Inf"), h.Count)
+				fmt.Fprintf(out, "%s_sum%s %v\n", desc.name, s, h.Sum)
+				fmt.Fprintf(out, "%s_count%s %d\n", desc.name, s, h.Count)
+			}
+		}
+	}
+}
+
+func withLabel(series, name, value string) string {
+	label := fmt.Sprintf("%s=%q", name, value)
+	if series == "" {
+		return "{" + label + "}"
+	}
+	return strings.TrimSuffix(series, "}") + "," + label + "}"
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func observeCall(command string, err error, d time.Duration) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	pendingMetrics.add(callsTotal, labels("command", command, "outcome", outcome), 1)
+	pendingMetrics.observe(callDuration, labels("command", command), d.Seconds())
+}
+
+func observeFetch(backend string, d time.Duration) {
+	pendingMetrics.observe(fetchDuration, labels("backend", backend), d.Seconds())
+}
+
+func countDecryptFailure(backend string) {
+	pendingMetrics.add(decryptFailures, labels("backend", backend), 1)
+}
+
+func countBytesWritten(n int) {
+	pendingMetrics.add(bytesWritten, "", float64(n))
+}
+
+// countingDecryptor counts the failures of the Decryptor it wraps
+type countingDecryptor struct {
+	Decryptor
+	backend string
+}
+
+func (c countingDecryptor) Decrypt(cipherText string) ([]byte, error) {
+	clearText, err := c.Decryptor.Decrypt(cipherText)
+	if err != nil {
+		countDecryptFailure(c.backend)
+	}
+	return clearText, err
+}
+
+// flushMetrics merges what this invocation observed into the host wide
+// metrics and rewrites the textfile. Every driver call is its own process,
+// so this is done under the state store lock and the textfile is replaced
+// atomically for node-exporter.
+func flushMetrics(store *stateStore, dir string) error {
+	if dir == "" {
+		return nil
+	}
+
+	unlock, err := store.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state := newMetricsState()
+	if err := store.get(metricsStateKind, metricsStateKind, state); err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("Resetting unreadable metrics state: %v", err)
+		state = newMetricsState()
+	}
+
+	volumes, err := store.list(volumeStateKind)
+	if err != nil {
+		return err
+	}
+	pendingMetrics.set(volumesActive, "", float64(len(volumes)))
+
+	state.merge(pendingMetrics)
+	if err := store.put(metricsStateKind, metricsStateKind, state); err != nil {
+		return err
+	}
+	pendingMetrics = newMetricsState()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// node-exporter only reads *.prom, so the temp file is never collected
+	tmp, err := ioutil.TempFile(dir, ".secrets_flexvol-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	state.write(tmp)
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path.Join(dir, metricsFile))
+}
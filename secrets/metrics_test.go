@@ -0,0 +1,68 @@
+package secrets
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFlushMetrics(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store := newStateStore(path.Join(tmpDir, "state"))
+	dir := path.Join(tmpDir, "textfile")
+	store.put(volumeStateKind, "vol", &volumeRecord{Name: "vol"})
+
+	defer func(orig *metricsState) { pendingMetrics = orig }(pendingMetrics)
+
+	// Two invocations of the driver, each flushing what it observed
+	pendingMetrics = newMetricsState()
+	observeCall("attach", nil, 30*time.Millisecond)
+	observeFetch(rancherBackend, 20*time.Millisecond)
+	countBytesWritten(7)
+	if err := flushMetrics(store, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	observeCall("attach", errors.New("failed"), 2*time.Second)
+	countDecryptFailure(rancherBackend)
+	countBytesWritten(3)
+	if err := flushMetrics(store, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(path.Join(dir, metricsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"# TYPE secrets_flexvol_calls_total counter\n",
+		`secrets_flexvol_calls_total{command="attach",outcome="success"} 1` + "\n",
+		`secrets_flexvol_calls_total{command="attach",outcome="failure"} 1` + "\n",
+		`secrets_flexvol_call_duration_seconds_bucket{command="attach",le="0.05"} 1` + "\n",
+		`secrets_flexvol_call_duration_seconds_bucket{command="attach",le="+Inf"} 2` + "\n",
+		`secrets_flexvol_call_duration_seconds_count{command="attach"} 2` + "\n",
+		`secrets_flexvol_fetch_duration_seconds_count{backend="rancher"} 1` + "\n",
+		`secrets_flexvol_decrypt_failures_total{backend="rancher"} 1` + "\n",
+		"secrets_flexvol_written_bytes_total 10\n",
+		"secrets_flexvol_volumes_active 1\n",
+	} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("Expected %q in:\n%s", want, content)
+		}
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Expected only the textfile in %s, got %d files", dir, len(files))
+	}
+}
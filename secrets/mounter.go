@@ -0,0 +1,37 @@
+package secrets
+
+import (
+	"github.com/docker/docker/pkg/mount"
+)
+
+// Mounter is the mount layer of the driver, so that it can run against a
+// fake mount table in tests.
+type Mounter interface {
+	Mount(device, target, fsType, options string) error
+	Unmount(target string) error
+	Mounted(target string) (bool, error)
+	GetMounts() ([]*mount.Info, error)
+}
+
+// hostMounter mounts on the host, it is used by a FlexVolume without a
+// Mounter and by the commands inspecting the host.
+var hostMounter Mounter = dockerMounter{}
+
+// dockerMounter implements Mounter with docker/pkg/mount
+type dockerMounter struct{}
+
+func (dockerMounter) Mount(device, target, fsType, options string) error {
+	return mount.Mount(device, target, fsType, options)
+}
+
+func (dockerMounter) Unmount(target string) error {
+	return mount.Unmount(target)
+}
+
+func (dockerMounter) Mounted(target string) (bool, error) {
+	return mount.Mounted(target)
+}
+
+func (dockerMounter) GetMounts() ([]*mount.Info, error) {
+	return mount.GetMounts()
+}
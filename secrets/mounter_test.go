@@ -0,0 +1,100 @@
+package secrets
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/pkg/mount"
+)
+
+type fakeMount struct {
+	device  string
+	fsType  string
+	options string
+	minor   int
+}
+
+// fakeMounter is an in memory mount table. It records every call and fails
+// those listed in fail, keyed by method name.
+type fakeMounter struct {
+	mounts    map[string]fakeMount
+	calls     []string
+	fail      map[string]error
+	nextMinor int
+}
+
+func newFakeMounter() *fakeMounter {
+	return &fakeMounter{
+		mounts:    map[string]fakeMount{},
+		fail:      map[string]error{},
+		nextMinor: 50,
+	}
+}
+
+func (f *fakeMounter) Mount(device, target, fsType, options string) error {
+	f.calls = append(f.calls, fmt.Sprintf("mount %s %s %s %s", device, target, fsType, options))
+	if err := f.fail["Mount"]; err != nil {
+		return err
+	}
+
+	m := fakeMount{device: device, fsType: fsType, options: options}
+	if src, ok := f.mounts[device]; ok && strings.Contains(options, "bind") {
+		// bind mounts share the device of their source
+		m.fsType = src.fsType
+		m.minor = src.minor
+	} else {
+		f.nextMinor++
+		m.minor = f.nextMinor
+	}
+	f.mounts[target] = m
+
+	return nil
+}
+
+func (f *fakeMounter) Unmount(target string) error {
+	f.calls = append(f.calls, "unmount "+target)
+	if err := f.fail["Unmount"]; err != nil {
+		return err
+	}
+
+	if _, ok := f.mounts[target]; !ok {
+		return syscall.EINVAL
+	}
+	delete(f.mounts, target)
+	return nil
+}
+
+func (f *fakeMounter) Mounted(target string) (bool, error) {
+	if err := f.fail["Mounted"]; err != nil {
+		return false, err
+	}
+	_, ok := f.mounts[target]
+	return ok, nil
+}
+
+func (f *fakeMounter) GetMounts() ([]*mount.Info, error) {
+	if err := f.fail["GetMounts"]; err != nil {
+		return nil, err
+	}
+
+	targets := []string{}
+	for target := range f.mounts {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	infos := []*mount.Info{}
+	for _, target := range targets {
+		m := f.mounts[target]
+		infos = append(infos, &mount.Info{
+			Mountpoint: target,
+			Source:     m.device,
+			Fstype:     m.fsType,
+			Opts:       m.options,
+			Minor:      m.minor,
+		})
+	}
+	return infos, nil
+}
@@ -0,0 +1,89 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+const openPGPMessageType = "PGP MESSAGE"
+
+type openPGPDecryptor struct {
+	keyring openpgp.EntityList
+}
+
+// NewOpenPGPDecryptor returns a Decryptor for OpenPGP messages using the
+// secret keys in the keyring at keyringPath. Armored and binary keyrings
+// are accepted.
+func NewOpenPGPDecryptor(keyringPath string) (Decryptor, error) {
+	keyData, err := ioutil.ReadFile(keyringPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyring openpgp.EntityList
+	if bytes.Contains(keyData, []byte("-----BEGIN PGP")) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(keyData))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(keyData))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keyring.DecryptionKeys()) == 0 {
+		return nil, errors.New("No OpenPGP decryption keys found in " + keyringPath)
+	}
+
+	return openPGPDecryptor{
+		keyring: keyring,
+	}, nil
+}
+
+// Decrypt implements the Decryptor interface. The cipherText is the base64
+// encoded OpenPGP message, armored or binary.
+func (o openPGPDecryptor) Decrypt(cipherText string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(cipherText)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	var src io.Reader = bytes.NewReader(data)
+	if isOpenPGPArmored(data) {
+		block, err := armor.Decode(src)
+		if err != nil {
+			return []byte{}, err
+		}
+		if block.Type != openPGPMessageType {
+			return []byte{}, errors.New("Unexpected OpenPGP armor type: " + block.Type)
+		}
+		src = block.Body
+	}
+
+	md, err := openpgp.ReadMessage(src, o.keyring, nil, nil)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	clearText, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	// A signature by a key in the keyring is only checked once the body has
+	// been read in full. Signers we don't know about are not an error.
+	if md.SignedBy != nil && md.SignatureError != nil {
+		return []byte{}, md.SignatureError
+	}
+
+	return clearText, nil
+}
+
+func isOpenPGPArmored(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN PGP MESSAGE-----"))
+}
@@ -0,0 +1,337 @@
+package secrets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	tokenOption   = "io.rancher.secrets.token"
+	kubeletPrefix = "kubernetes.io/"
+)
+
+// OptionError reports a volume option that failed to decode or validate
+type OptionError struct {
+	Option string
+	Value  interface{}
+	Reason string
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("Invalid volume option %q: %s", e.Option, e.Reason)
+}
+
+// optionSpec describes one volume option. field returns a pointer into the
+// options struct, check validates the value once coerced to a string and def
+// is applied when the option is not given.
+type optionSpec struct {
+	name  string
+	field func(o *options) interface{}
+	check func(v string) error
+	def   string
+}
+
+// optionSchema documents every option the driver understands:
+//
+//	name            volume name, required for attach
+//	device          staged volume path, set by create
+//	rancher         "true" when invoked by Rancher
+//	backend         rancher (default), file, sops or composite
+//	secretsPath     directory or file below the file backend root
+//	backends        comma separated backends for the composite backend
+//	conflictPolicy  first-wins (default), last-wins or error
+//	cacheTTL        cache encrypted rewrap blobs, e.g. 5m
+//	cacheMaxStale   oldest cache entry used when the backend is down
+//	mode            octal mode of the volume directory, default 0755
+//	sizeLimit       tmpfs size, default sized from the secrets, alias size
+//	inodeLimit      tmpfs inodes, default sized from the secrets
+//	mountOpts       extra tmpfs mount options, noexec,nosuid,nodev always
+//	                apply and options that would weaken them are rejected
+//	medium          tmpfs (default) or ramfs, which is never swapped
+//	swap            tmpfs with swap active: warn (default), allow or refuse
+//	items           comma separated secret names to project, default all
+//	readOnly        bind mount the volume read only
+//
+// Strings, numbers and bools are coerced to the field type. Options set by
+// kubelet are accepted, anything else is logged and ignored.
+var optionSchema = []optionSpec{
+	{name: "name", field: func(o *options) interface{} { return &o.Name }, check: isFileName},
+	{name: "device", field: func(o *options) interface{} { return &o.Device }},
+	{name: "rancher", field: func(o *options) interface{} { return &o.Rancher }},
+	{name: "backend", field: func(o *options) interface{} { return &o.Backend },
+		check: oneOf(rancherBackend, fileBackend, sopsBackend, compositeBackend)},
+	{name: "secretsPath", field: func(o *options) interface{} { return &o.SecretsPath }},
+	{name: "backends", field: func(o *options) interface{} { return &o.Backends }},
+	{name: "conflictPolicy", field: func(o *options) interface{} { return &o.ConflictPolicy },
+		check: oneOf(FirstWins, LastWins, ConflictError)},
+	{name: "cacheTTL", field: func(o *options) interface{} { return &o.CacheTTL }, check: isDuration},
+	{name: "cacheMaxStale", field: func(o *options) interface{} { return &o.CacheMaxStale }, check: isDuration},
+	{name: "mode", field: func(o *options) interface{} { return &o.Mode }, def: "0755"},
+	{name: "size", field: func(o *options) interface{} { return &o.SizeLimit }, check: isSize},
+	{name: "sizeLimit", field: func(o *options) interface{} { return &o.SizeLimit }, check: isSize},
+	{name: "inodeLimit", field: func(o *options) interface{} { return &o.InodeLimit }, check: isInodeCount},
+	{name: "mountOpts", field: func(o *options) interface{} { return &o.MountOpts }, check: isSafeMountOpts},
+	{name: "medium", field: func(o *options) interface{} { return &o.Medium },
+		check: oneOf(tmpfsMedium, ramfsMedium), def: tmpfsMedium},
+	{name: "swap", field: func(o *options) interface{} { return &o.Swap },
+		check: oneOf(swapWarn, swapAllow, swapRefuse), def: swapWarn},
+	{name: "items", field: func(o *options) interface{} { return &o.Items }},
+	{name: "readOnly", field: func(o *options) interface{} { return &o.ReadOnly }},
+	{name: "kubernetes.io/readwrite", field: func(o *options) interface{} { return &o.ReadWrite },
+		check: oneOf("rw", "ro")},
+	{name: "kubernetes.io/pod.name", field: func(o *options) interface{} { return &o.PodName }},
+	{name: "kubernetes.io/pod.namespace", field: func(o *options) interface{} { return &o.PodNamespace }},
+	{name: "kubernetes.io/pod.uid", field: func(o *options) interface{} { return &o.PodUID }},
+	{name: "kubernetes.io/serviceAccount.name", field: func(o *options) interface{} { return &o.ServiceAccount }},
+}
+
+// knownOptions are passed by Rancher or kubelet but not used by the driver
+var knownOptions = map[string]bool{
+	tokenOption:                    true,
+	"kubernetes.io/fsType":         true,
+	"kubernetes.io/pvOrVolumeName": true,
+}
+
+// newOptions decodes the options passed to attach, which requires a token
+// for the Rancher backend. Rancher hands over the token JSON escaped, kubelet
+// passes values verbatim, so the token is unescaped exactly once and only for
+// Rancher. No other value is altered. Rancher invocations lose any
+// kubernetes.io/ options, which would otherwise grant them a pod's secrets.
+func newOptions(params map[string]interface{}) (*options, error) {
+	option := &options{}
+
+	// There is no pod behind Rancher, do not let options pretend to be one
+	if isRancherInvocation(params) {
+		for k := range params {
+			if strings.HasPrefix(k, kubeletPrefix) {
+				delete(params, k)
+			}
+		}
+	}
+
+	if raw, ok := params[tokenOption]; ok {
+		tkn, ok := raw.(string)
+		if !ok {
+			return option, &OptionError{Option: tokenOption, Reason: fmt.Sprintf("expected a string, got %T", raw)}
+		}
+
+		logRedactor.addValue(tkn)
+		if !isKubeletInvocation(params) {
+			unescaped, err := unescapeOnce(tkn)
+			if err != nil {
+				return option, &OptionError{Option: tokenOption, Reason: err.Error()}
+			}
+			tkn = unescaped
+		}
+
+		logRedactor.addValue(tkn)
+		delete(params, tokenOption)
+		option.Token = &secretToken{
+			Value: []byte(tkn),
+		}
+	}
+
+	if err := option.decode(params); err != nil {
+		return option, err
+	}
+
+	if option.Token == nil && (option.Backend == "" || option.Backend == rancherBackend) {
+		return option, &OptionError{Option: tokenOption, Reason: "no token passed"}
+	}
+
+	return option, nil
+}
+
+// decodeOptions decodes the options for create and mount, which take no
+// token.
+func decodeOptions(params map[string]interface{}) (*options, error) {
+	option := &options{}
+	return option, option.decode(params)
+}
+
+func (o *options) decode(params map[string]interface{}) error {
+	known := map[string]bool{}
+
+	for _, spec := range optionSchema {
+		known[spec.name] = true
+
+		raw, ok := params[spec.name]
+		if !ok || raw == nil {
+			if spec.def == "" {
+				continue
+			}
+			raw = spec.def
+		}
+		if err := spec.decode(o, raw); err != nil {
+			return err
+		}
+	}
+
+	for k := range params {
+		if !known[k] && !knownOptions[k] {
+			logrus.Warnf("Ignoring unknown volume option %q", k)
+		}
+	}
+
+	return nil
+}
+
+func (spec optionSpec) decode(o *options, raw interface{}) error {
+	if _, isList := raw.([]interface{}); isList {
+		if _, ok := spec.field(o).(*[]string); !ok {
+			return &OptionError{Option: spec.name, Value: raw, Reason: "a list is not allowed"}
+		}
+	}
+
+	v, err := coerceString(raw)
+	if err != nil {
+		return &OptionError{Option: spec.name, Value: raw, Reason: err.Error()}
+	}
+
+	if spec.check != nil {
+		if err := spec.check(v); err != nil {
+			return &OptionError{Option: spec.name, Value: raw, Reason: err.Error()}
+		}
+	}
+
+	switch field := spec.field(o).(type) {
+	case *string:
+		*field = v
+	case *bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return &OptionError{Option: spec.name, Value: raw, Reason: "expected true or false"}
+		}
+		*field = b
+	case *os.FileMode:
+		// Modes are always octal, whether given as "0640" or 640
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return &OptionError{Option: spec.name, Value: raw, Reason: "expected an octal file mode"}
+		}
+		if mode > 0777 {
+			return &OptionError{Option: spec.name, Value: raw, Reason: "mode must be between 0000 and 0777"}
+		}
+		*field = os.FileMode(mode)
+	case *[]string:
+		if list, ok := raw.([]interface{}); ok {
+			items := []string{}
+			for _, item := range list {
+				s, ok := item.(string)
+				if !ok {
+					return &OptionError{Option: spec.name, Value: raw, Reason: "expected a list of strings"}
+				}
+				items = append(items, s)
+			}
+			*field = items
+		} else {
+			*field = splitList(v)
+		}
+	}
+	return nil
+}
+
+// coerceString returns the string form of a JSON scalar. Lists are handled
+// by the caller.
+func coerceString(raw interface{}) (string, error) {
+	switch v := raw.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		if v != float64(int64(v)) {
+			return "", fmt.Errorf("expected a whole number, got %v", v)
+		}
+		return strconv.FormatInt(int64(v), 10), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case []interface{}:
+		return "", nil
+	}
+	return "", fmt.Errorf("unsupported type %T", raw)
+}
+
+func isRancherInvocation(params map[string]interface{}) bool {
+	raw, ok := params["rancher"]
+	if !ok || raw == nil {
+		return false
+	}
+	v, err := coerceString(raw)
+	if err != nil {
+		return false
+	}
+	rancher, _ := strconv.ParseBool(v)
+	return rancher
+}
+
+func isKubeletInvocation(params map[string]interface{}) bool {
+	for k := range params {
+		if strings.HasPrefix(k, kubeletPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeOnce undoes one level of JSON string escaping. Values that are
+// quoted are decoded as a JSON string, values without a backslash are
+// returned as is.
+func unescapeOnce(v string) (string, error) {
+	quoted := v
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		if !strings.Contains(v, `\`) {
+			return v, nil
+		}
+		quoted = `"` + v + `"`
+	}
+
+	var out string
+	if err := json.Unmarshal([]byte(quoted), &out); err != nil {
+		return "", fmt.Errorf("malformed escaping: %v", err)
+	}
+	return out, nil
+}
+
+func oneOf(values ...string) func(string) error {
+	return func(v string) error {
+		for _, allowed := range values {
+			if v == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(values, ", "))
+	}
+}
+
+var (
+	sizePattern  = regexp.MustCompile(`^[1-9][0-9]*[kmg%]?$`)
+	inodePattern = regexp.MustCompile(`^[1-9][0-9]*[kmg]?$`)
+)
+
+func isSize(v string) error {
+	if !sizePattern.MatchString(v) {
+		return errors.New("expected a size such as 64k, 10m, 1g or 50%")
+	}
+	return nil
+}
+
+func isInodeCount(v string) error {
+	if !inodePattern.MatchString(v) {
+		return errors.New("expected an inode count such as 512 or 1k")
+	}
+	return nil
+}
+
+func isDuration(v string) error {
+	_, err := time.ParseDuration(v)
+	return err
+}
@@ -0,0 +1,159 @@
+package secrets
+
+import (
+	"testing"
+)
+
+func TestNewOptionsToken(t *testing.T) {
+	tests := []struct {
+		params   map[string]interface{}
+		expected string
+	}{
+		// Rancher escapes the token once
+		{map[string]interface{}{"name": "vol", tokenOption: `eyJh\/b+c=`}, `eyJh/b+c=`},
+		{map[string]interface{}{"name": "vol", tokenOption: `"{\"key\":\"a\\\\b\"}"`}, `{"key":"a\\b"}`},
+		{map[string]interface{}{"name": "vol", tokenOption: `plain`}, `plain`},
+		// kubelet passes it verbatim
+		{map[string]interface{}{"name": "vol", tokenOption: `a\/b`, "kubernetes.io/pod.uid": "uid"}, `a\/b`},
+	}
+
+	for _, test := range tests {
+		opts, err := newOptions(test.params)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(opts.Token.Value) != test.expected {
+			t.Errorf("Expected token %s, got %s", test.expected, string(opts.Token.Value))
+		}
+	}
+}
+
+func TestNewOptionsRancherDropsPod(t *testing.T) {
+	opts, err := newOptions(map[string]interface{}{
+		tokenOption:                         `a\/b`,
+		"name":                              "vol",
+		"rancher":                           "true",
+		"kubernetes.io/pod.namespace":       "default",
+		"kubernetes.io/serviceAccount.name": "app",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.PodNamespace != "" || opts.ServiceAccount != "" {
+		t.Errorf("Expected no pod for Rancher, got namespace %q and service account %q", opts.PodNamespace, opts.ServiceAccount)
+	}
+	if string(opts.Token.Value) != "a/b" {
+		t.Errorf("Expected the Rancher token to be unescaped, got %s", string(opts.Token.Value))
+	}
+}
+
+func TestNewOptionsPreservesValues(t *testing.T) {
+	opts, err := newOptions(map[string]interface{}{
+		tokenOption:   "token",
+		"name":        "vol",
+		"secretsPath": `team\app`,
+		"rancher":     "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.SecretsPath != `team\app` {
+		t.Errorf("Expected backslash to be preserved, got %s", opts.SecretsPath)
+	}
+	if !opts.Rancher {
+		t.Error("Expected rancher to be true")
+	}
+}
+
+func TestNewOptionsErrors(t *testing.T) {
+	tests := []struct {
+		params map[string]interface{}
+		option string
+	}{
+		{map[string]interface{}{"name": "vol"}, tokenOption},
+		{map[string]interface{}{"name": "vol", tokenOption: `bad\escape`}, tokenOption},
+		{map[string]interface{}{"name": "vol", tokenOption: 42.0}, tokenOption},
+		{map[string]interface{}{"name": []interface{}{"a"}, tokenOption: "t"}, "name"},
+		{map[string]interface{}{"name": "vol", tokenOption: "t", "mode": "0999"}, "mode"},
+		{map[string]interface{}{"name": "vol", tokenOption: "t", "mode": 1777.0}, "mode"},
+		{map[string]interface{}{"name": "vol", tokenOption: "t", "size": "-1m"}, "size"},
+		{map[string]interface{}{"name": "vol", tokenOption: "t", "readOnly": 1.5}, "readOnly"},
+		{map[string]interface{}{"name": "vol", tokenOption: "t", "inodeLimit": "0"}, "inodeLimit"},
+		{map[string]interface{}{"name": "vol", tokenOption: "t", "mountOpts": "size=1m,exec"}, "mountOpts"},
+		{map[string]interface{}{"name": "vol", "backend": "vault"}, "backend"},
+		{map[string]interface{}{"name": "vol", tokenOption: "t", "cacheTTL": "soon"}, "cacheTTL"},
+		{map[string]interface{}{"name": "vol", tokenOption: "t", "rancher": "maybe"}, "rancher"},
+	}
+
+	for _, test := range tests {
+		_, err := newOptions(test.params)
+		optErr, ok := err.(*OptionError)
+		if !ok {
+			t.Errorf("Expected OptionError for %v, got %v", test.params, err)
+			continue
+		}
+		if optErr.Option != test.option {
+			t.Errorf("Expected error for option %s, got %s", test.option, optErr.Option)
+		}
+	}
+}
+
+func TestDecodeOptionsCoercion(t *testing.T) {
+	opts, err := decodeOptions(map[string]interface{}{
+		"name":     "vol",
+		"mode":     750.0,
+		"size":     "1m",
+		"items":    []interface{}{"a", "b"},
+		"readOnly": true,
+		"unknown":  "x",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.Mode != 0750 {
+		t.Errorf("Expected mode 0750, got %o", opts.Mode)
+	}
+	if opts.SizeLimit != "1m" {
+		t.Errorf("Expected size 1m, got %s", opts.SizeLimit)
+	}
+	if len(opts.Items) != 2 || opts.Items[1] != "b" {
+		t.Errorf("Expected items [a b], got %v", opts.Items)
+	}
+	if !opts.ReadOnly {
+		t.Error("Expected readOnly")
+	}
+
+	opts, err = decodeOptions(map[string]interface{}{"mode": "0640", "items": "a, b,", "readOnly": "false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Mode != 0640 || len(opts.Items) != 2 || opts.ReadOnly {
+		t.Errorf("Unexpected string coercion: %+v", opts)
+	}
+
+	// Defaults
+	opts, _ = decodeOptions(map[string]interface{}{})
+	if opts.Mode != 0755 || opts.SizeLimit != "" {
+		t.Errorf("Expected default mode and no size limit, got %o %s", opts.Mode, opts.SizeLimit)
+	}
+}
+
+func TestSelectItems(t *testing.T) {
+	secrets := []secret{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+
+	selected, err := selectItems(secrets, []string{"c", "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 2 || selected[0].Name != "c" || selected[1].Name != "a" {
+		t.Errorf("Unexpected selection %v", selected)
+	}
+
+	if _, err := selectItems(secrets, []string{"d"}); err == nil {
+		t.Error("Expected missing item to fail")
+	}
+}
@@ -0,0 +1,313 @@
+package secrets
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	providerAPIVersion      = "v1alpha1"
+	providerRuntimeName     = "secrets-flexvol"
+	defaultProviderEndpoint = "unix:///etc/kubernetes/secrets-store-csi-providers/rancher.sock"
+
+	// providerClassAttribute names the SecretProviderClass of the volume,
+	// which is not a volume option
+	providerClassAttribute = "secretProviderClass"
+
+	// providerKeyFile holds the key of the object versions, in the state dir
+	providerKeyFile = "provider.key"
+)
+
+// ProviderCommand serves backend as a provider of the Secrets Store CSI
+// Driver, which mounts the files the provider returns itself.
+func ProviderCommand(backend *FlexVolume) cli.Command {
+	return cli.Command{
+		Name:  "provider",
+		Usage: "Serve the Secrets Store CSI Driver provider API",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "endpoint", Value: defaultProviderEndpoint, EnvVar: "PROVIDER_ENDPOINT", Usage: "unix socket to serve on"},
+		},
+		Action: func(c *cli.Context) error {
+			listener, err := listenCSI(c.String("endpoint"))
+			if err != nil {
+				return err
+			}
+
+			server := newProviderServer(newSecretsProvider(backend, c.App.Version))
+
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			go func() {
+				<-signals
+				server.GracefulStop()
+			}()
+
+			logrus.Infof("Serving Secrets Store CSI Driver provider on %s", c.String("endpoint"))
+			return server.Serve(listener)
+		},
+	}
+}
+
+func newProviderServer(provider *secretsProvider) *grpc.Server {
+	server := grpc.NewServer(grpc.ForceServerCodec(providerCodec{}))
+	server.RegisterService(&providerServiceDesc, provider)
+	return server
+}
+
+// providerServer is the v1alpha1.CSIDriverProvider service
+type providerServer interface {
+	Version(ctx context.Context, req *providerVersionRequest) (*providerVersionResponse, error)
+	Mount(ctx context.Context, req *providerMountRequest) (*providerMountResponse, error)
+}
+
+var providerServiceDesc = grpc.ServiceDesc{
+	ServiceName: "v1alpha1.CSIDriverProvider",
+	HandlerType: (*providerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Version",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &providerVersionRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				if interceptor == nil {
+					return srv.(providerServer).Version(ctx, req)
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/v1alpha1.CSIDriverProvider/Version"}
+				return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(providerServer).Version(ctx, req.(*providerVersionRequest))
+				})
+			},
+		},
+		{
+			MethodName: "Mount",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &providerMountRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				if interceptor == nil {
+					return srv.(providerServer).Mount(ctx, req)
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/v1alpha1.CSIDriverProvider/Mount"}
+				return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(providerServer).Mount(ctx, req.(*providerMountRequest))
+				})
+			},
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "service.proto",
+}
+
+// secretsProvider implements the provider API on a FlexVolume. Calls are
+// serialized like those of the CSI driver.
+type secretsProvider struct {
+	mu      sync.Mutex
+	sv      *FlexVolume
+	version string
+}
+
+func newSecretsProvider(sv *FlexVolume, version string) *secretsProvider {
+	return &secretsProvider{
+		sv:      sv,
+		version: version,
+	}
+}
+
+func (p *secretsProvider) Version(ctx context.Context, req *providerVersionRequest) (*providerVersionResponse, error) {
+	return &providerVersionResponse{
+		Version:        providerAPIVersion,
+		RuntimeName:    providerRuntimeName,
+		RuntimeVersion: p.version,
+	}, nil
+}
+
+// Mount fetches and decrypts the secrets of a volume and returns them as
+// files. The driver calls it again to rotate secrets, so a token may be
+// reused by the pod and volume it was first used for.
+func (p *secretsProvider) Mount(ctx context.Context, req *providerMountRequest) (*providerMountResponse, error) {
+	attributes := map[string]string{}
+	if err := json.Unmarshal([]byte(req.Attributes), &attributes); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid attributes: %v", err)
+	}
+
+	secrets := map[string]string{}
+	if req.Secrets != "" {
+		if err := json.Unmarshal([]byte(req.Secrets), &secrets); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid secrets: %v", err)
+		}
+	}
+
+	var permission os.FileMode
+	if req.Permission != "" {
+		if err := json.Unmarshal([]byte(req.Permission), &permission); err != nil || permission > 0777 {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid permission %q", req.Permission)
+		}
+	}
+
+	// The target is .../volumes/kubernetes.io~csi/<volume>/mount
+	if req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing")
+	}
+	name := path.Base(path.Dir(path.Clean(req.TargetPath)))
+	if err := isFileName(name); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Volume name %q of target %s %v", name, req.TargetPath, err)
+	}
+
+	delete(attributes, providerClassAttribute)
+	params := volumeContextParams(attributes, secrets, name)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	files, versions, err := p.sv.fetch(params, permission)
+	if err != nil {
+		return nil, csiError(err)
+	}
+
+	return &providerMountResponse{
+		ObjectVersion: versions,
+		Files:         files,
+	}, nil
+}
+
+// fetch runs the getter and writer of attach into memory and returns what
+// was written as files, with an HMAC of each keyed by providerVersionKey as
+// its version. Secrets without a mode get permission, when set.
+func (sv *FlexVolume) fetch(params map[string]interface{}, permission os.FileMode) (files []*providerFile, versions []*providerObjectVersion, err error) {
+	log := newCallLog("fetch")
+	event := newAuditEvent(auditFetch)
+	defer func() { sv.finish(log, event, err) }()
+
+	options, err := newOptions(params)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.withOptions(options)
+	event.withOptions(options)
+
+	cfg := sv.config()
+	if err := claimToken(newStateStore(cfg.stateDir), options); err != nil {
+		return nil, nil, err
+	}
+
+	secretGetter, secretWriter, err := sv.secretBackend(options, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fetchStart := time.Now()
+	fetchSpan := startSpan("GetSecrets")
+	fetchSpan.setAttribute("backend", event.Backend)
+	secrets, err := secretGetter.GetSecrets(options)
+	fetchSpan.finish(err)
+	observeFetch(event.Backend, time.Since(fetchStart))
+	if err != nil {
+		return nil, nil, err
+	}
+	logRedactor.addSecrets(secrets)
+
+	secrets, err = selectItems(secrets, options.Items)
+	if err != nil {
+		return nil, nil, err
+	}
+	event.withSecrets(secrets)
+
+	if permission != 0 {
+		for i := range secrets {
+			if secrets[i].Mode == "" {
+				secrets[i].Mode = fmt.Sprintf("%04o", permission)
+			}
+		}
+	}
+
+	// Files go straight into the response, cleartext is never written
+	memory := &memorySecretWriter{writer: secretWriter}
+	defer func() {
+		if err != nil {
+			for _, f := range memory.files {
+				zero(f.Contents)
+			}
+		}
+	}()
+	if err := memory.Write(secrets, ""); err != nil {
+		return nil, nil, err
+	}
+
+	key, err := providerVersionKey(cfg.stateDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records := []secretRecord{}
+	for _, f := range memory.files {
+		sum := sha256.Sum256(f.Contents)
+		records = append(records, secretRecord{Name: f.Name, SHA256: hex.EncodeToString(sum[:])})
+
+		version := hmac.New(sha256.New, key)
+		version.Write(f.Contents)
+
+		files = append(files, &providerFile{Path: f.Name, Mode: int32(f.Mode), Contents: f.Contents})
+		versions = append(versions, &providerObjectVersion{ID: "secret/" + f.Name, Version: hex.EncodeToString(version.Sum(nil))})
+	}
+	event.withSecretRecords(records)
+
+	return files, versions, nil
+}
+
+// providerVersionKey returns the host-local key of the object versions,
+// created on first use. Versions are stored in the API server, where plain
+// hashes of short secrets could be guessed.
+func providerVersionKey(stateDir string) ([]byte, error) {
+	file := path.Join(stateDir, providerKeyFile)
+	key, err := ioutil.ReadFile(file)
+	if !os.IsNotExist(err) {
+		if err == nil && len(key) == 0 {
+			err = fmt.Errorf("Provider key %s is empty", file)
+		}
+		return key, err
+	}
+
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, err
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Write(key)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return key, err
+}
@@ -0,0 +1,173 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// newTestProvider serves the provider API for an e2e env on a socket in its
+// temp dir.
+func newTestProvider(t *testing.T) (*e2eEnv, *grpc.ClientConn, func()) {
+	e, cleanupEnv := newE2EEnv(t)
+
+	endpoint := "unix://" + path.Join(e.tmpDir, "providers", "rancher.sock")
+	listener, err := listenCSI(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newProviderServer(newSecretsProvider(e.sv, "v1.0.0"))
+	go server.Serve(listener)
+
+	conn, err := grpc.Dial(endpoint,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(providerCodec{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e, conn, func() {
+		conn.Close()
+		server.Stop()
+		cleanupEnv()
+	}
+}
+
+func providerMount(conn *grpc.ClientConn, req *providerMountRequest) (*providerMountResponse, error) {
+	resp := &providerMountResponse{}
+	err := conn.Invoke(context.Background(), "/v1alpha1.CSIDriverProvider/Mount", req, resp)
+	return resp, err
+}
+
+func newProviderMountRequest(e *e2eEnv, attributes map[string]string, token string) *providerMountRequest {
+	a, _ := json.Marshal(attributes)
+	s, _ := json.Marshal(map[string]string{tokenOption: token})
+	return &providerMountRequest{
+		Attributes: string(a),
+		Secrets:    string(s),
+		TargetPath: path.Join(e.tmpDir, "pods", "abc", "volumes", "kubernetes.io~csi", "secrets", "mount"),
+		Permission: "420",
+	}
+}
+
+func TestProviderVersion(t *testing.T) {
+	_, conn, cleanup := newTestProvider(t)
+	defer cleanup()
+
+	resp := &providerVersionResponse{}
+	req := &providerVersionRequest{Version: providerAPIVersion}
+	if err := conn.Invoke(context.Background(), "/v1alpha1.CSIDriverProvider/Version", req, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Version != providerAPIVersion || resp.RuntimeName != providerRuntimeName || resp.RuntimeVersion != "v1.0.0" {
+		t.Errorf("Unexpected version %+v", resp)
+	}
+}
+
+func TestProviderMount(t *testing.T) {
+	e, conn, cleanup := newTestProvider(t)
+	defer cleanup()
+
+	e.api.grant("provider-token", e2eSecrets...)
+	req := newProviderMountRequest(e, map[string]string{
+		"secretProviderClass":              "rancher",
+		"csi.storage.k8s.io/pod.name":      "web-0",
+		"csi.storage.k8s.io/pod.namespace": "default",
+		"csi.storage.k8s.io/pod.uid":       "abc",
+	}, "provider-token")
+
+	// Rotation mounts again with the same token
+	for i := 0; i < 2; i++ {
+		resp, err := providerMount(conn, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Files) != len(e2eSecrets) || len(resp.ObjectVersion) != len(e2eSecrets) {
+			t.Fatalf("Unexpected response %+v", resp)
+		}
+		for j, s := range e2eSecrets {
+			f := resp.Files[j]
+			if f.Path != s.Name || !bytes.Equal(f.Contents, []byte(s.Value)) {
+				t.Errorf("Unexpected file %s %q", f.Path, f.Contents)
+			}
+
+			mode := int32(0644)
+			if s.Mode != "" {
+				mode = 0400
+			}
+			if f.Mode != mode {
+				t.Errorf("Unexpected mode %o of %s", f.Mode, f.Path)
+			}
+
+			key, _ := ioutil.ReadFile(path.Join(e.sv.cfg.stateDir, providerKeyFile))
+			version := hmac.New(sha256.New, key)
+			version.Write([]byte(s.Value))
+			ov := resp.ObjectVersion[j]
+			if len(key) != 32 || ov.ID != "secret/"+s.Name || ov.Version != hex.EncodeToString(version.Sum(nil)) {
+				t.Errorf("Unexpected object version %+v", ov)
+			}
+		}
+	}
+
+	// The token is bound to the pod that used it first
+	other := newProviderMountRequest(e, map[string]string{"csi.storage.k8s.io/pod.uid": "def"}, "provider-token")
+	if _, err := providerMount(conn, other); err == nil {
+		t.Error("Token replayed by another pod")
+	}
+}
+
+func TestProviderMountErrors(t *testing.T) {
+	e, conn, cleanup := newTestProvider(t)
+	defer cleanup()
+
+	valid := newProviderMountRequest(e, map[string]string{}, "unknown-token")
+	requests := map[*providerMountRequest]codes.Code{
+		{Attributes: "{", TargetPath: valid.TargetPath}:                      codes.InvalidArgument,
+		{Attributes: "{}", Secrets: "[]", TargetPath: valid.TargetPath}:      codes.InvalidArgument,
+		{Attributes: "{}", Permission: "4095", TargetPath: valid.TargetPath}: codes.InvalidArgument,
+		{Attributes: "{}"}:                  codes.InvalidArgument,
+		{Attributes: "{}", TargetPath: "/"}: codes.InvalidArgument,
+		{Attributes: `{"backend":"unknown"}`, Secrets: valid.Secrets, TargetPath: "/a/b"}: codes.InvalidArgument,
+		valid: codes.Internal,
+	}
+	for req, code := range requests {
+		if _, err := providerMount(conn, req); status.Code(err) != code {
+			t.Errorf("Expected %s for %+v, got %v", code, req, err)
+		}
+	}
+}
+
+func TestProviderWire(t *testing.T) {
+	resp := &providerMountResponse{
+		ObjectVersion: []*providerObjectVersion{{ID: "secret/a", Version: "1"}},
+		Error:         &providerError{Code: "Failed"},
+		Files:         []*providerFile{{Path: "a", Mode: -1, Contents: []byte{0, 1}}, {Path: "b"}},
+	}
+
+	decoded := &providerMountResponse{}
+	if err := decoded.unmarshal(resp.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Error.Code != "Failed" || len(decoded.Files) != 2 || decoded.Files[0].Mode != -1 ||
+		!bytes.Equal(decoded.Files[0].Contents, []byte{0, 1}) || decoded.ObjectVersion[0].Version != "1" {
+		t.Errorf("Unexpected round trip %+v", decoded)
+	}
+
+	for _, b := range [][]byte{{0x0a}, {0x0a, 0x05, 0x00}, {0x08, 0x01}, {0xff}} {
+		if err := decoded.unmarshal(b); err == nil {
+			t.Errorf("Expected %x to fail", b)
+		}
+	}
+}
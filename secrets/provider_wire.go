@@ -0,0 +1,312 @@
+package secrets
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of the v1alpha1 provider API of the Secrets Store CSI Driver,
+// sigs.k8s.io/secrets-store-csi-driver/provider/v1alpha1/service.proto. The
+// API is small and stable, so the messages are encoded by hand rather than
+// vendoring the driver.
+
+type providerVersionRequest struct {
+	Version string
+}
+
+type providerVersionResponse struct {
+	Version        string
+	RuntimeName    string
+	RuntimeVersion string
+}
+
+type providerMountRequest struct {
+	// Attributes, Secrets and Permission are JSON encoded
+	Attributes           string
+	Secrets              string
+	TargetPath           string
+	Permission           string
+	CurrentObjectVersion []*providerObjectVersion
+}
+
+type providerMountResponse struct {
+	ObjectVersion []*providerObjectVersion
+	Error         *providerError
+	Files         []*providerFile
+}
+
+type providerFile struct {
+	Path     string
+	Mode     int32
+	Contents []byte
+}
+
+type providerObjectVersion struct {
+	ID      string
+	Version string
+}
+
+type providerError struct {
+	Code string
+}
+
+// providerMessage is implemented by the messages of the provider API
+type providerMessage interface {
+	marshal() []byte
+	unmarshal(b []byte) error
+}
+
+// providerCodec encodes the provider messages on the wire as protobuf
+type providerCodec struct{}
+
+func (providerCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(providerMessage)
+	if !ok {
+		return nil, fmt.Errorf("Cannot marshal %T as a provider message", v)
+	}
+	return m.marshal(), nil
+}
+
+func (providerCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(providerMessage)
+	if !ok {
+		return fmt.Errorf("Cannot unmarshal %T as a provider message", v)
+	}
+	return m.unmarshal(data)
+}
+
+func (providerCodec) Name() string {
+	return "proto"
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendMessage(b []byte, num protowire.Number, m providerMessage) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m.marshal())
+}
+
+// consumeFields calls field with the number, type and value of each field of
+// b. Bytes values are passed as is, varints as their encoding.
+func consumeFields(b []byte, field func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v []byte
+		if typ == protowire.BytesType {
+			v, n = protowire.ConsumeBytes(b)
+		} else {
+			if n = protowire.ConsumeFieldValue(num, typ, b); n >= 0 {
+				v = b[:n]
+			}
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := field(num, typ, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stringField is the value of a string field, or an error if the field was
+// encoded with another type.
+func stringField(num protowire.Number, typ protowire.Type, v []byte) (string, error) {
+	if typ != protowire.BytesType {
+		return "", fmt.Errorf("Field %d has wire type %d, expected bytes", num, typ)
+	}
+	return string(v), nil
+}
+
+func (m *providerVersionRequest) marshal() []byte {
+	return appendString(nil, 1, m.Version)
+}
+
+func (m *providerVersionRequest) unmarshal(b []byte) error {
+	*m = providerVersionRequest{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) (err error) {
+		if num == 1 {
+			m.Version, err = stringField(num, typ, v)
+		}
+		return err
+	})
+}
+
+func (m *providerVersionResponse) marshal() []byte {
+	b := appendString(nil, 1, m.Version)
+	b = appendString(b, 2, m.RuntimeName)
+	return appendString(b, 3, m.RuntimeVersion)
+}
+
+func (m *providerVersionResponse) unmarshal(b []byte) error {
+	*m = providerVersionResponse{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) (err error) {
+		switch num {
+		case 1:
+			m.Version, err = stringField(num, typ, v)
+		case 2:
+			m.RuntimeName, err = stringField(num, typ, v)
+		case 3:
+			m.RuntimeVersion, err = stringField(num, typ, v)
+		}
+		return err
+	})
+}
+
+func (m *providerMountRequest) marshal() []byte {
+	b := appendString(nil, 1, m.Attributes)
+	b = appendString(b, 2, m.Secrets)
+	b = appendString(b, 3, m.TargetPath)
+	b = appendString(b, 4, m.Permission)
+	for _, ov := range m.CurrentObjectVersion {
+		b = appendMessage(b, 5, ov)
+	}
+	return b
+}
+
+func (m *providerMountRequest) unmarshal(b []byte) error {
+	*m = providerMountRequest{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) (err error) {
+		switch num {
+		case 1:
+			m.Attributes, err = stringField(num, typ, v)
+		case 2:
+			m.Secrets, err = stringField(num, typ, v)
+		case 3:
+			m.TargetPath, err = stringField(num, typ, v)
+		case 4:
+			m.Permission, err = stringField(num, typ, v)
+		case 5:
+			ov := &providerObjectVersion{}
+			if _, err = stringField(num, typ, v); err == nil {
+				err = ov.unmarshal(v)
+			}
+			m.CurrentObjectVersion = append(m.CurrentObjectVersion, ov)
+		}
+		return err
+	})
+}
+
+func (m *providerMountResponse) marshal() []byte {
+	var b []byte
+	for _, ov := range m.ObjectVersion {
+		b = appendMessage(b, 1, ov)
+	}
+	if m.Error != nil {
+		b = appendMessage(b, 2, m.Error)
+	}
+	for _, f := range m.Files {
+		b = appendMessage(b, 3, f)
+	}
+	return b
+}
+
+func (m *providerMountResponse) unmarshal(b []byte) error {
+	*m = providerMountResponse{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num < 1 || num > 3 {
+			return nil
+		}
+		if _, err := stringField(num, typ, v); err != nil {
+			return err
+		}
+
+		switch num {
+		case 1:
+			ov := &providerObjectVersion{}
+			m.ObjectVersion = append(m.ObjectVersion, ov)
+			return ov.unmarshal(v)
+		case 2:
+			m.Error = &providerError{}
+			return m.Error.unmarshal(v)
+		default:
+			f := &providerFile{}
+			m.Files = append(m.Files, f)
+			return f.unmarshal(v)
+		}
+	})
+}
+
+func (m *providerFile) marshal() []byte {
+	b := appendString(nil, 1, m.Path)
+	if m.Mode != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(int64(m.Mode)))
+	}
+	return appendBytes(b, 3, m.Contents)
+}
+
+func (m *providerFile) unmarshal(b []byte) error {
+	*m = providerFile{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) (err error) {
+		switch num {
+		case 1:
+			m.Path, err = stringField(num, typ, v)
+		case 2:
+			if typ != protowire.VarintType {
+				return fmt.Errorf("Field %d has wire type %d, expected varint", num, typ)
+			}
+			mode, _ := protowire.ConsumeVarint(v)
+			m.Mode = int32(mode)
+		case 3:
+			if _, err = stringField(num, typ, v); err == nil {
+				m.Contents = append([]byte{}, v...)
+			}
+		}
+		return err
+	})
+}
+
+func (m *providerObjectVersion) marshal() []byte {
+	b := appendString(nil, 1, m.ID)
+	return appendString(b, 2, m.Version)
+}
+
+func (m *providerObjectVersion) unmarshal(b []byte) error {
+	*m = providerObjectVersion{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) (err error) {
+		switch num {
+		case 1:
+			m.ID, err = stringField(num, typ, v)
+		case 2:
+			m.Version, err = stringField(num, typ, v)
+		}
+		return err
+	})
+}
+
+func (m *providerError) marshal() []byte {
+	return appendString(nil, 1, m.Code)
+}
+
+func (m *providerError) unmarshal(b []byte) error {
+	*m = providerError{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) (err error) {
+		if num == 1 {
+			m.Code, err = stringField(num, typ, v)
+		}
+		return err
+	})
+}
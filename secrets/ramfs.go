@@ -0,0 +1,151 @@
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	tmpfsMedium = "tmpfs"
+	ramfsMedium = "ramfs"
+
+	// defaultRamfsSize caps ramfs volumes without a sizeLimit
+	defaultRamfsSize = "1m"
+)
+
+var ramfsSizePattern = regexp.MustCompile(`^([0-9]+)([kmg]?)$`)
+
+// ramfsMountOptions keeps the flags and mode from mountOpts, the mode option
+// applies otherwise. ramfs has no size or inode limits, the size is enforced
+// by a cappedSecretWriter.
+func ramfsMountOptions(options *options) (string, error) {
+	if err := isSafeMountOpts(options.MountOpts); err != nil {
+		return "", &OptionError{Option: "mountOpts", Value: options.MountOpts, Reason: err.Error()}
+	}
+
+	opts := []string{}
+	hasMode := false
+	for _, opt := range splitList(options.MountOpts) {
+		if strings.Contains(opt, "=") && !strings.HasPrefix(opt, "mode=") {
+			continue
+		}
+		hasMode = hasMode || strings.HasPrefix(opt, "mode=")
+		opts = append(opts, opt)
+	}
+	if !hasMode {
+		opts = append(opts, fmt.Sprintf("mode=%04o", options.Mode))
+	}
+
+	for _, flag := range enforcedMountOpts {
+		found := false
+		for _, opt := range opts {
+			found = found || opt == flag
+		}
+		if !found {
+			opts = append(opts, flag)
+		}
+	}
+
+	return strings.Join(opts, ","), nil
+}
+
+// ramfsSizeLimit returns the byte limit for a ramfs volume, from sizeLimit or
+// defaultRamfsSize.
+func ramfsSizeLimit(options *options) (int64, error) {
+	size := options.SizeLimit
+	if size == "" {
+		size = defaultRamfsSize
+	}
+
+	limit, err := parseSize(size)
+	if err != nil {
+		return 0, &OptionError{Option: "sizeLimit", Value: size, Reason: err.Error()}
+	}
+	return limit, nil
+}
+
+// parseSize parses sizes as used by tmpfs, percentages are not supported.
+func parseSize(size string) (int64, error) {
+	if strings.HasSuffix(size, "%") {
+		return 0, fmt.Errorf("percentage size %s is not supported for ramfs", size)
+	}
+
+	match := ramfsSizePattern.FindStringSubmatch(size)
+	if match == nil {
+		return 0, fmt.Errorf("invalid size %q, expected bytes with an optional k, m or g suffix", size)
+	}
+
+	n, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	multiplier := map[string]int64{"": 1, "k": 1 << 10, "m": 1 << 20, "g": 1 << 30}[match[2]]
+	if n > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("size %s is too large", size)
+	}
+	return n * multiplier, nil
+}
+
+// NewCappedSecretWriter returns a SecretWriter that refuses to write a
+// secret beyond limit bytes and removes what was written when it does.
+func NewCappedSecretWriter(writer SecretWriter, limit int64) (SecretWriter, error) {
+	return &cappedSecretWriter{
+		writer: writer,
+		limit:  limit,
+	}, nil
+}
+
+// Write writes the secrets one at a time, each capped to what is left of the
+// limit so writeFile fails before a file would exceed it.
+func (csw cappedSecretWriter) Write(secrets []secret, dstDir string) error {
+	created := []string{}
+	for _, s := range secrets {
+		used, err := dirSize(dstDir)
+		if err != nil {
+			return err
+		}
+
+		// A file written again on re-attach gives its old size back
+		file := path.Join(dstDir, s.Name)
+		if fi, err := os.Stat(file); err == nil {
+			used -= fi.Size()
+		} else {
+			created = append(created, file)
+		}
+
+		s.maxSize = csw.limit - used
+		if s.maxSize < 1 {
+			err = fmt.Errorf("Secrets use %d bytes, nothing is left of the volume limit of %d bytes", used, csw.limit)
+		} else {
+			err = csw.writer.Write([]secret{s}, dstDir)
+		}
+
+		if err != nil {
+			for _, file := range created {
+				os.Remove(file)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func dirSize(dir string) (int64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	size := int64(0)
+	for _, fi := range files {
+		size += fi.Size()
+	}
+	return size, nil
+}
@@ -0,0 +1,168 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRamfsMountOptions(t *testing.T) {
+	mountOpts, err := ramfsMountOptions(&options{MountOpts: "size=1m,mode=0700,noatime", Mode: 0755})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mountOpts != "mode=0700,noatime,noexec,nosuid,nodev" {
+		t.Errorf("Unexpected ramfs mount options %s", mountOpts)
+	}
+
+	mountOpts, err = ramfsMountOptions(&options{MountOpts: "noatime", Mode: 0750})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mountOpts != "noatime,mode=0750,noexec,nosuid,nodev" {
+		t.Errorf("Unexpected ramfs mount options %s", mountOpts)
+	}
+
+	if _, err := ramfsMountOptions(&options{MountOpts: "exec"}); err == nil {
+		t.Error("Expected exec to be rejected")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"512":   512,
+		"4k":    4096,
+		"10m":   10 * 1024 * 1024,
+		"1g":    1024 * 1024 * 1024,
+		"1024k": 1024 * 1024,
+	}
+	for size, expected := range tests {
+		n, err := parseSize(size)
+		if err != nil || n != expected {
+			t.Errorf("parseSize(%s) = %d, %v expected %d", size, n, err, expected)
+		}
+	}
+
+	for _, size := range []string{"50%", "-1", "10mk", "k", "", "1 m", "99999999999g"} {
+		if _, err := parseSize(size); err == nil {
+			t.Errorf("Expected size %q to be rejected", size)
+		}
+	}
+
+	limit, err := ramfsSizeLimit(&options{})
+	if err != nil || limit != 1024*1024 {
+		t.Errorf("Expected default ramfs limit of 1m, got %d, %v", limit, err)
+	}
+}
+
+func TestCappedWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capped-writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sw, _ := NewRSASecretFileWriter(testDecryptor{})
+
+	capped, _ := NewCappedSecretWriter(sw, 4)
+	if err := capped.Write(tGet.Data, dir); err == nil {
+		t.Error("Expected write beyond the limit to fail")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected secrets to be removed after failing, found %d files", len(files))
+	}
+
+	// The second secret must be refused before it is written
+	maxUsed := int64(0)
+	probe := secretWriterFunc(func(secrets []secret, dstDir string) error {
+		err := sw.Write(secrets, dstDir)
+		if used, _ := dirSize(dstDir); used > maxUsed {
+			maxUsed = used
+		}
+		return err
+	})
+	capped, _ = NewCappedSecretWriter(probe, 7)
+	if err := capped.Write(tGet.Data, dir); err == nil {
+		t.Error("Expected write beyond the limit to fail")
+	}
+	if maxUsed != 5 {
+		t.Errorf("Expected only the first secret to be written, used %d bytes", maxUsed)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected secrets to be removed after failing, found %d files", len(files))
+	}
+
+	capped, _ = NewCappedSecretWriter(sw, 1024)
+	if err := capped.Write(tGet.Data, dir); err != nil {
+		t.Error(err)
+	}
+
+	// Re-attach overwrites the same files, which must not count twice
+	used, _ := dirSize(dir)
+	capped, _ = NewCappedSecretWriter(sw, used)
+	if err := capped.Write(tGet.Data, dir); err != nil {
+		t.Errorf("Expected re-attach within the limit to succeed: %v", err)
+	}
+
+	// A failed re-attach keeps the files written by the earlier attach
+	capped, _ = NewCappedSecretWriter(sw, used-1)
+	if err := capped.Write(tGet.Data, dir); err == nil {
+		t.Error("Expected write beyond the limit to fail")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != len(tGet.Data) {
+		t.Errorf("Expected %d secrets to be kept after failing, found %d files", len(tGet.Data), len(files))
+	}
+}
+
+type secretWriterFunc func(secrets []secret, dstDir string) error
+
+func (f secretWriterFunc) Write(secrets []secret, dstDir string) error {
+	return f(secrets, dstDir)
+}
+
+func TestSwapActive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "swaps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(origPath string, origLock func() error) {
+		swapsPath, lockMemory = origPath, origLock
+	}(swapsPath, lockMemory)
+	swapsPath = path.Join(dir, "swaps")
+	locked := false
+	lockMemory = func() error {
+		locked = true
+		return nil
+	}
+
+	header := "Filename\t\t\t\tType\t\tSize\tUsed\tPriority\n"
+	tests := map[string]bool{
+		header: false,
+		header + "/dev/sda2                               partition\t8388604\t0\t-2\n": true,
+	}
+
+	for content, expected := range tests {
+		ioutil.WriteFile(swapsPath, []byte(content), 0644)
+		active, err := swapActive()
+		if err != nil {
+			t.Error(err)
+		}
+		if active != expected {
+			t.Errorf("Expected swap active %v for %q", expected, content)
+		}
+	}
+
+	ioutil.WriteFile(swapsPath, []byte(header+"/swapfile file 1024 0 -2\n"), 0644)
+	if err := checkSwap(&options{Swap: swapRefuse, Medium: tmpfsMedium}); err == nil {
+		t.Error("Expected tmpfs with swap to be refused")
+	}
+	if err := checkSwap(&options{Swap: swapRefuse, Medium: ramfsMedium}); err != nil {
+		t.Errorf("Expected ramfs with swap to be accepted, got %v", err)
+	}
+	if !locked {
+		t.Error("Expected driver memory to be locked with swap active")
+	}
+}
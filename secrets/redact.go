@@ -0,0 +1,174 @@
+package secrets
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	redacted = "[REDACTED]"
+
+	// Shorter cleartext is not redacted, it would match all over the log
+	minRedactedLen = 6
+	// Entries longer than this are not scanned for cleartext
+	maxScannedLen = 64 * 1024
+)
+
+var sensitiveFields = []string{"token", "rewrap", "cleartext", "password"}
+
+// redactor remembers values that must never be logged. Tokens and rewrap
+// blobs are kept as they are, cleartext only as salted hashes of its
+// content so that registering it does not outlive the wiping of the buffer.
+type redactor struct {
+	mu      sync.Mutex
+	values  map[string]bool
+	salt    []byte
+	digests map[int]map[[sha256.Size]byte]bool
+}
+
+var logRedactor = newRedactor()
+
+func init() {
+	logrus.AddHook(redactionHook{logRedactor})
+}
+
+func newRedactor() *redactor {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+
+	return &redactor{
+		values:  map[string]bool{},
+		salt:    salt,
+		digests: map[int]map[[sha256.Size]byte]bool{},
+	}
+}
+
+func (r *redactor) addValue(value string) {
+	if len(value) < minRedactedLen {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values[value] = true
+}
+
+func (r *redactor) addClearText(clearText []byte) {
+	if len(clearText) < minRedactedLen {
+		return
+	}
+
+	sum := r.digest(clearText)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.digests[len(clearText)] == nil {
+		r.digests[len(clearText)] = map[[sha256.Size]byte]bool{}
+	}
+	r.digests[len(clearText)][sum] = true
+}
+
+func (r *redactor) addSecrets(secrets []secret) {
+	for _, s := range secrets {
+		r.addValue(s.RewrapText)
+		r.addClearText(s.clearText)
+	}
+}
+
+// reset forgets all registered values, once the call that registered them
+// has logged its outcome. A long running process would otherwise keep them
+// for as long as it runs.
+func (r *redactor) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values = map[string]bool{}
+	r.digests = map[int]map[[sha256.Size]byte]bool{}
+}
+
+func (r *redactor) digest(b []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(r.salt)
+	h.Write(b)
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// scrub replaces every registered value in s
+func (r *redactor) scrub(s string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for value := range r.values {
+		s = strings.Replace(s, value, redacted, -1)
+	}
+
+	if len(s) > maxScannedLen {
+		return s
+	}
+
+	for l, sums := range r.digests {
+		for i := 0; i+l <= len(s); i++ {
+			if sums[r.digest([]byte(s[i:i+l]))] {
+				s = s[:i] + redacted + s[i+l:]
+				i += len(redacted) - 1
+			}
+		}
+	}
+
+	return s
+}
+
+// redactionHook scrubs the message and fields of every log entry
+type redactionHook struct {
+	redactor *redactor
+}
+
+func (h redactionHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h redactionHook) Fire(entry *logrus.Entry) error {
+	entry.Message = h.redactor.scrub(entry.Message)
+
+	// Data is shared with the parent entry, never modify it in place
+	data := make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		if isSensitiveField(k) {
+			data[k] = redacted
+			continue
+		}
+
+		switch v := v.(type) {
+		case string:
+			data[k] = h.redactor.scrub(v)
+		case []byte:
+			data[k] = redacted
+		case error:
+			data[k] = h.redactor.scrub(v.Error())
+		case fmt.Stringer:
+			data[k] = h.redactor.scrub(v.String())
+		default:
+			data[k] = v
+		}
+	}
+	entry.Data = data
+
+	return nil
+}
+
+func isSensitiveField(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range sensitiveFields {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
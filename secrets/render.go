@@ -0,0 +1,165 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/urfave/cli"
+)
+
+// RenderCommand runs the attach pipeline into an ordinary directory, for
+// debugging without root, tmpfs or kubelet.
+func RenderCommand() cli.Command {
+	return cli.Command{
+		Name:  "render",
+		Usage: "Render the secrets of a volume into a directory without mounting",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "token", Usage: "secrets token, as io.rancher.secrets.token"},
+			cli.StringFlag{Name: "out", Usage: "directory to write the secrets to"},
+			cli.BoolFlag{Name: "dry-run", Usage: "only list names, sizes, modes and owners"},
+			cli.StringFlag{Name: "name", Value: "render", Usage: "volume name"},
+			cli.StringSliceFlag{Name: "option, o", Usage: "volume option as key=value, may be repeated"},
+			cli.StringFlag{Name: "host-key", Value: hostKeyPath, Usage: "RSA host key"},
+			cli.StringFlag{Name: "age-identity", Value: hostAgeIdentityPath, Usage: "age identity file"},
+			cli.StringFlag{Name: "keyring", Value: hostKeyringPath, Usage: "OpenPGP keyring"},
+			cli.StringFlag{Name: "secrets-root", Value: fileSecretsRoot, Usage: "root of the file and sops backends"},
+		},
+		Action: renderVol,
+	}
+}
+
+func renderVol(c *cli.Context) error {
+	if c.String("out") == "" && !c.Bool("dry-run") {
+		return errors.New("Either --out or --dry-run is required")
+	}
+
+	params := map[string]interface{}{
+		"name": c.String("name"),
+	}
+	for _, opt := range c.StringSlice("option") {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("Option %q is not key=value", opt)
+		}
+		params[kv[0]] = kv[1]
+	}
+	if c.String("token") != "" {
+		params[tokenOption] = c.String("token")
+	}
+
+	options, err := newOptions(params)
+	if err != nil {
+		return err
+	}
+
+	cfg := defaultHostConfig()
+	cfg.keyPath = c.String("host-key")
+	cfg.ageIdentityPath = c.String("age-identity")
+	cfg.keyringPath = c.String("keyring")
+	cfg.fileSecretsRoot = c.String("secrets-root")
+	// The host admin running render may read any secretsPath
+	cfg.fileAccessPath = ""
+
+	// A dry run decrypts into memory and writes nothing
+	dst := c.String("out")
+	if c.Bool("dry-run") {
+		dst = ""
+	} else if err := os.MkdirAll(dst, 0700); err != nil {
+		return err
+	}
+
+	files, err := render(options, cfg, dst)
+	if err != nil {
+		return err
+	}
+
+	return listRendered(os.Stdout, files)
+}
+
+// render runs the same getter and writer as attach into dst, or into memory
+// when dst is empty. The contents of what went to memory are wiped.
+func render(options *options, cfg hostConfig, dst string) ([]renderedFile, error) {
+	secretGetter, secretWriter, err := newSecretBackend(options, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets, err := secretGetter.GetSecrets(options)
+	if err != nil {
+		return nil, err
+	}
+	logRedactor.addSecrets(secrets)
+
+	secrets, err = selectItems(secrets, options.Items)
+	if err != nil {
+		return nil, err
+	}
+
+	if dst == "" {
+		memory := &memorySecretWriter{writer: secretWriter}
+		err := memory.Write(secrets, "")
+		for _, f := range memory.files {
+			zero(f.Contents)
+		}
+		return memory.files, err
+	}
+
+	if err := secretWriter.Write(secrets, dst); err != nil {
+		return nil, err
+	}
+	return statRendered(dst, secrets)
+}
+
+// statRendered tells what a container would see of the secrets in dir, even
+// when chown was skipped because we are not root.
+func statRendered(dir string, secrets []secret) ([]renderedFile, error) {
+	files := []renderedFile{}
+	for _, s := range secrets {
+		fi, err := os.Stat(path.Join(dir, s.Name))
+		if err != nil {
+			return nil, err
+		}
+
+		s.setDefaults()
+		uid, gid := s.UID, s.GID
+		if stat, ok := fi.Sys().(*syscall.Stat_t); ok && os.Geteuid() == 0 {
+			uid, gid = fmt.Sprint(stat.Uid), fmt.Sprint(stat.Gid)
+		}
+
+		files = append(files, renderedFile{Name: s.Name, Size: fi.Size(), Mode: fi.Mode().Perm(), UID: uid, GID: gid})
+	}
+	return files, nil
+}
+
+func listRendered(out io.Writer, files []renderedFile) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tMODE\tUID\tGID")
+
+	for _, f := range files {
+		fmt.Fprintf(w, "%s\t%d\t%04o\t%s\t%s\n", f.Name, f.Size, f.Mode, f.UID, f.GID)
+	}
+
+	return w.Flush()
+}
+
+// Write keeps what the wrapped writer would write to dst in memory, as
+// files. Callers own their contents and are expected to wipe them.
+func (msw *memorySecretWriter) Write(secrets []secret, dst string) error {
+	capture := func(file renderedFile) {
+		msw.files = append(msw.files, file)
+	}
+
+	for _, s := range secrets {
+		s.capture = capture
+		if err := msw.writer.Write([]secret{s}, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
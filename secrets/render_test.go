@@ -0,0 +1,58 @@
+package secrets
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestRender(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "render")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	identity, _ := age.GenerateX25519Identity()
+	cfg := hostConfig{
+		ageIdentityPath: path.Join(tmpDir, "host.age"),
+		fileSecretsRoot: path.Join(tmpDir, "secrets"),
+	}
+	ioutil.WriteFile(cfg.ageIdentityPath, []byte(identity.String()+"\n"), 0600)
+
+	os.MkdirAll(path.Join(cfg.fileSecretsRoot, "app"), 0755)
+	writeAgeFile(t, path.Join(cfg.fileSecretsRoot, "app", "db_password.age"), false, "hunter2", identity.Recipient())
+
+	options, err := newOptions(map[string]interface{}{"name": "vol", "backend": fileBackend, "secretsPath": "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := path.Join(tmpDir, "out")
+	os.MkdirAll(out, 0700)
+
+	for _, dst := range []string{out, ""} {
+		files, err := render(options, cfg, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		listing := &bytes.Buffer{}
+		if err := listRendered(listing, files); err != nil {
+			t.Fatal(err)
+		}
+
+		lines := strings.Split(strings.TrimSpace(listing.String()), "\n")
+		if len(lines) != 2 || strings.Join(strings.Fields(lines[1]), " ") != "db_password 7 0444 0 0" {
+			t.Errorf("Unexpected listing into %q:\n%s", dst, listing.String())
+		}
+		if strings.Contains(listing.String(), "hunter2") {
+			t.Error("Listing must not contain secret content")
+		}
+	}
+}
@@ -9,8 +9,24 @@ import (
 	"encoding/pem"
 	"errors"
 	"io/ioutil"
+	"os"
+	"sync"
 )
 
+// hostKeys keeps the parsed private keys, so the daemon reads the host key
+// once rather than on every call. A key is read again when its file changes.
+var hostKeys = &keyCache{keys: map[string]cachedKey{}}
+
+type keyCache struct {
+	mu   sync.Mutex
+	keys map[string]cachedKey
+}
+
+type cachedKey struct {
+	fi  os.FileInfo
+	key *rsa.PrivateKey
+}
+
 // Decryptor handles decrypting messages
 type Decryptor interface {
 	Decrypt(cipherText string) ([]byte, error)
@@ -40,21 +56,44 @@ func (r rsaDecryptor) Decrypt(cipherText string) ([]byte, error) {
 }
 
 func loadPrivateKeyFromFile(keyPath string) (*rsa.PrivateKey, error) {
+	fi, err := os.Stat(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeys.mu.Lock()
+	defer hostKeys.mu.Unlock()
+
+	if cached, ok := hostKeys.keys[keyPath]; ok && os.SameFile(cached.fi, fi) &&
+		cached.fi.ModTime().Equal(fi.ModTime()) && cached.fi.Size() == fi.Size() {
+		return cached.key, nil
+	}
+	delete(hostKeys.keys, keyPath)
+
 	keyData, err := ioutil.ReadFile(keyPath)
 	if err != nil {
 		return nil, err
 	}
 
-	block, _ := pem.Decode(keyData)
-	if block == nil {
-		return nil, errors.New("Could not decode private key. Is it PEM format?")
+	key, err := parsePrivateKey(keyData)
+	if err != nil {
+		return nil, err
 	}
 
-	return x509.ParsePKCS1PrivateKey(block.Bytes)
+	hostKeys.keys[keyPath] = cachedKey{fi: fi, key: key}
+	return key, nil
 }
 
 func loadPrivateKeyFromString(keyString string) (*rsa.PrivateKey, error) {
-	block, _ := pem.Decode([]byte(keyString))
+	return parsePrivateKey([]byte(keyString))
+}
+
+func parsePrivateKey(keyData []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return nil, errors.New("Could not decode private key. Is it PEM format?")
+	}
+
 	return x509.ParsePKCS1PrivateKey(block.Bytes)
 }
 
@@ -1,7 +1,14 @@
 package secrets
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
 )
 
@@ -60,3 +67,42 @@ func TestDecrypt(t *testing.T) {
 		return
 	}
 }
+
+func TestLoadPrivateKeyFromFileCache(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyPath := path.Join(tmpDir, "host.key")
+	if err := ioutil.WriteFile(keyPath, []byte(insecureKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := loadPrivateKeyFromFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second, err := loadPrivateKeyFromFile(keyPath); err != nil || second != first {
+		t.Errorf("Key was not cached: %v", err)
+	}
+
+	// A rotated key is read again
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(newKey)}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if rotated, err := loadPrivateKeyFromFile(keyPath); err != nil || rotated.N.Cmp(newKey.N) != 0 {
+		t.Errorf("Rotated key was not read: %v", err)
+	}
+
+	os.Remove(keyPath)
+	if _, err := loadPrivateKeyFromFile(keyPath); !os.IsNotExist(err) {
+		t.Errorf("Expected removed key to fail, got %v", err)
+	}
+}
@@ -2,10 +2,13 @@ package secrets
 
 import (
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 )
 
 func (s *secret) setDefaults() error {
@@ -24,16 +27,33 @@ func (s *secret) setDefaults() error {
 	return nil
 }
 
-func (s *secret) writeFile(basedir string, content []byte) error {
-	fullPath := path.Join(basedir, s.Name)
+// writeBase64File decodes content into a buffer that is wiped once written
+func (s *secret) writeBase64File(basedir string, content []byte) error {
 	output := make([]byte, base64.StdEncoding.DecodedLen(len(content)))
-	// Make sure defaults are set otherwise things could fail silently.
+	defer zero(output)
 
 	l, err := base64.StdEncoding.Decode(output, content)
 	if err != nil {
 		return err
 	}
 
+	return s.writeFile(basedir, output[:l])
+}
+
+// writeFile writes the cleartext content of the secret. Callers own content
+// and are expected to wipe it.
+func (s *secret) writeFile(basedir string, content []byte) (err error) {
+	span := startSpan("writeFile")
+	span.setAttribute("secret", s.Name)
+	defer func() { span.finish(err) }()
+
+	// Names come from the backend, never let them escape the volume
+	if s.Name == "" || isFileName(s.Name) != nil {
+		return fmt.Errorf("Invalid secret name %q", s.Name)
+	}
+	fullPath := path.Join(basedir, s.Name)
+
+	// Make sure defaults are set otherwise things could fail silently.
 	if err := s.setDefaults(); err != nil {
 		return err
 	}
@@ -42,12 +62,34 @@ func (s *secret) writeFile(basedir string, content []byte) error {
 	if err != nil {
 		return err
 	}
+	if mode > 0777 {
+		return fmt.Errorf("Invalid mode %s for secret %s", s.Mode, s.Name)
+	}
+
+	if s.maxSize > 0 && int64(len(content)) > s.maxSize {
+		return fmt.Errorf("Secret %s has %d bytes, more than the %d bytes left of the volume limit", s.Name, len(content), s.maxSize)
+	}
+
+	logRedactor.addClearText(content)
+
+	if s.capture != nil {
+		s.capture(renderedFile{
+			Name:     s.Name,
+			Size:     int64(len(content)),
+			Mode:     os.FileMode(mode),
+			UID:      s.UID,
+			GID:      s.GID,
+			Contents: append([]byte{}, content...),
+		})
+		return nil
+	}
 
 	// Create the file and always truncate
-	err = ioutil.WriteFile(fullPath, output[:l], os.FileMode(mode))
+	err = ioutil.WriteFile(fullPath, content, os.FileMode(mode))
 	if err != nil {
 		return err
 	}
+	countBytesWritten(len(content))
 
 	uid, err := strconv.Atoi(s.UID)
 	if err != nil {
@@ -59,8 +101,11 @@ func (s *secret) writeFile(basedir string, content []byte) error {
 		return err
 	}
 
-	if err = os.Chown(fullPath, uid, gid); err != nil {
-		return err
+	// Only root can chown, skip it when rendering as an ordinary user
+	if os.Geteuid() == 0 {
+		if err = os.Chown(fullPath, uid, gid); err != nil {
+			return err
+		}
 	}
 
 	if err = os.Chmod(fullPath, os.FileMode(mode)); err != nil {
@@ -69,3 +114,12 @@ func (s *secret) writeFile(basedir string, content []byte) error {
 
 	return nil
 }
+
+// isFileName accepts a single path element, so names of volumes and secrets
+// cannot escape the directory they are joined onto.
+func isFileName(v string) error {
+	if v == "." || v == ".." || strings.ContainsAny(v, "/\x00") {
+		return errors.New("must be a file name, without / or NUL")
+	}
+	return nil
+}
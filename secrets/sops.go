@@ -0,0 +1,344 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const sopsMetadataKey = "sops"
+
+var sopsEncryptedValue = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.+),iv:(.+),tag:(.+),type:(.+)\]$`)
+
+type sopsMetadata struct {
+	LastModified    string         `yaml:"lastmodified"`
+	MAC             string         `yaml:"mac"`
+	Age             []sopsKey      `yaml:"age"`
+	PGP             []sopsKey      `yaml:"pgp"`
+	KeyGroups       []sopsKeyGroup `yaml:"key_groups"`
+	ShamirThreshold int            `yaml:"shamir_threshold"`
+}
+
+type sopsKeyGroup struct {
+	Age []sopsKey `yaml:"age"`
+	PGP []sopsKey `yaml:"pgp"`
+}
+
+type sopsKey struct {
+	Enc string `yaml:"enc"`
+}
+
+// NewSOPSSecretGetter returns a SecretGetter that projects every value of a
+// SOPS document below rootDir into its own secret.
+func NewSOPSSecretGetter(rootDir string, params *options, decryptor Decryptor) (SecretGetter, error) {
+	return &sopsSecretGetter{
+		file:      securePath(rootDir, params.SecretsPath),
+		decryptor: decryptor,
+	}, nil
+}
+
+// GetSecrets decrypts the document and verifies its MAC before returning any
+// values. The cleartext of each secret is only kept in memory, to be written
+// and wiped by a clearTextSecretWriter.
+func (ssg sopsSecretGetter) GetSecrets(params *options) ([]secret, error) {
+	returnSecrets := []secret{}
+
+	data, err := ioutil.ReadFile(ssg.file)
+	if err != nil {
+		return returnSecrets, err
+	}
+
+	values, err := decryptSOPSDocument(data, decryptorIn(ssg.decryptor, params.span))
+	if err != nil {
+		return returnSecrets, err
+	}
+
+	for _, v := range values {
+		returnSecrets = append(returnSecrets, secret{
+			Name:      v.name,
+			clearText: v.value,
+		})
+	}
+
+	return returnSecrets, nil
+}
+
+// NewClearTextSecretWriter returns a SecretWriter for secrets that have
+// already been decrypted by their getter.
+func NewClearTextSecretWriter() (SecretWriter, error) {
+	return &clearTextSecretWriter{}, nil
+}
+
+func (ctw clearTextSecretWriter) Write(secrets []secret, dstDir string) error {
+	defer func() {
+		for _, secret := range secrets {
+			zero(secret.clearText)
+		}
+	}()
+
+	for _, secret := range secrets {
+		if err := secret.writeFile(dstDir, secret.clearText); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sopsValue struct {
+	name  string
+	value []byte
+}
+
+type sopsWalker struct {
+	key    []byte
+	mac    hash.Hash
+	values []sopsValue
+}
+
+func decryptSOPSDocument(data []byte, decryptor Decryptor) ([]sopsValue, error) {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(data, doc); err != nil {
+		return nil, err
+	}
+
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("SOPS document must be a single mapping")
+	}
+	root := doc.Content[0]
+
+	var metadata *sopsMetadata
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == sopsMetadataKey {
+			metadata = &sopsMetadata{}
+			if err := root.Content[i+1].Decode(metadata); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if metadata == nil {
+		return nil, errors.New("Not a SOPS document, no sops metadata")
+	}
+
+	key, err := metadata.dataKey(decryptor)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(key)
+
+	w := &sopsWalker{
+		key: key,
+		mac: sha512.New(),
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == sopsMetadataKey {
+			continue
+		}
+		if err := w.walk(root.Content[i+1], []string{root.Content[i].Value}, []string{root.Content[i].Value}); err != nil {
+			w.wipe()
+			return nil, err
+		}
+	}
+
+	if err := metadata.verifyMAC(key, w.mac.Sum(nil)); err != nil {
+		w.wipe()
+		return nil, err
+	}
+
+	return w.values, nil
+}
+
+func (w *sopsWalker) wipe() {
+	for _, v := range w.values {
+		zero(v.value)
+	}
+}
+
+// dataKey decrypts the document data key with the first host identity that
+// matches one of the age or OpenPGP key entries.
+func (m *sopsMetadata) dataKey(decryptor Decryptor) ([]byte, error) {
+	keys := append([]sopsKey{}, m.Age...)
+	keys = append(keys, m.PGP...)
+
+	if len(m.KeyGroups) > 1 || m.ShamirThreshold > 1 {
+		return nil, errors.New("SOPS documents using Shamir key groups are not supported")
+	}
+	for _, group := range m.KeyGroups {
+		keys = append(keys, group.Age...)
+		keys = append(keys, group.PGP...)
+	}
+
+	var lastErr error
+	for _, k := range keys {
+		key, err := decryptor.Decrypt(base64.StdEncoding.EncodeToString([]byte(k.Enc)))
+		if err == nil {
+			return key, nil
+		}
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		return nil, errors.New("SOPS document has no age or OpenPGP keys")
+	}
+	return nil, fmt.Errorf("Failed to decrypt SOPS data key: %v", lastErr)
+}
+
+func (m *sopsMetadata) verifyMAC(key, sum []byte) error {
+	lastModified, err := time.Parse(time.RFC3339, m.LastModified)
+	if err != nil {
+		return err
+	}
+
+	mac, _, err := sopsDecrypt(key, m.MAC, lastModified.Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt SOPS MAC: %v", err)
+	}
+
+	if !hmac.Equal(mac, []byte(fmt.Sprintf("%X", sum))) {
+		return errors.New("SOPS MAC mismatch, document has been tampered with")
+	}
+
+	return nil
+}
+
+// walk decrypts every scalar below node in document order. The additional
+// data path follows SOPS and does not include list indexes, the secret name
+// does so that list items get distinct files.
+func (w *sopsWalker) walk(node *yaml.Node, path, name []string) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			k := node.Content[i].Value
+			if err := w.walk(node.Content[i+1], append(path, k), append(name, k)); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			if err := w.walk(item, path, append(name, strconv.Itoa(i))); err != nil {
+				return err
+			}
+		}
+	case yaml.AliasNode:
+		return w.walk(node.Alias, path, name)
+	case yaml.ScalarNode:
+		return w.scalar(node, path, name)
+	}
+	return nil
+}
+
+func (w *sopsWalker) scalar(node *yaml.Node, path, name []string) error {
+	var (
+		value    []byte
+		macValue []byte
+		err      error
+	)
+
+	if node.Tag == "!!str" && sopsEncryptedValue.MatchString(node.Value) {
+		value, macValue, err = sopsDecrypt(w.key, node.Value, strings.Join(path, ":")+":")
+		if err != nil {
+			return fmt.Errorf("Failed to decrypt %s: %v", strings.Join(name, "."), err)
+		}
+	} else {
+		value = []byte(node.Value)
+		macValue, err = sopsMACBytes(node.Tag, node.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.mac.Write(macValue)
+	zero(macValue)
+	if macValue == nil {
+		// comments are not part of the MAC or the volume
+		return nil
+	}
+
+	w.values = append(w.values, sopsValue{
+		name:  strings.Join(name, "."),
+		value: value,
+	})
+	return nil
+}
+
+// sopsDecrypt returns the cleartext of a SOPS encrypted value and its
+// representation for the MAC, nil for comments.
+func sopsDecrypt(key []byte, value, additionalData string) ([]byte, []byte, error) {
+	matches := sopsEncryptedValue.FindStringSubmatch(value)
+	if matches == nil {
+		return nil, nil, errors.New("Invalid SOPS encrypted value")
+	}
+
+	parts := make([][]byte, 3)
+	for i := range parts {
+		decoded, err := base64.StdEncoding.DecodeString(matches[i+1])
+		if err != nil {
+			return nil, nil, err
+		}
+		parts[i] = decoded
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	clearText, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	datatype := matches[4]
+	if datatype == "comment" {
+		return clearText, nil, nil
+	}
+
+	macValue, err := sopsMACBytes("!!"+datatype, string(clearText))
+	return clearText, macValue, err
+}
+
+// sopsMACBytes mirrors how SOPS serializes typed values into the MAC.
+func sopsMACBytes(tag, value string) ([]byte, error) {
+	switch tag {
+	case "!!int":
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(i)), nil
+	case "!!float":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatFloat(f, 'f', -1, 64)), nil
+	case "!!bool":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+		if b {
+			return []byte("True"), nil
+		}
+		return []byte("False"), nil
+	}
+	return []byte(value), nil
+}
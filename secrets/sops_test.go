@@ -0,0 +1,176 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+const sopsLastModified = "2017-01-02T15:04:05Z"
+
+// sopsEncrypt produces values the same way SOPS does.
+func sopsEncrypt(key []byte, value, datatype, additionalData string) string {
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCMWithNonceSize(block, 32)
+
+	iv := make([]byte, 32)
+	rand.Read(iv)
+
+	out := gcm.Seal(nil, iv, []byte(value), []byte(additionalData))
+	data, tag := out[:len(out)-gcm.Overhead()], out[len(out)-gcm.Overhead():]
+
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]",
+		base64.StdEncoding.EncodeToString(data),
+		base64.StdEncoding.EncodeToString(iv),
+		base64.StdEncoding.EncodeToString(tag),
+		datatype)
+}
+
+func sopsDocumentFixture(t *testing.T, recipient age.Recipient, mac string) string {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	encKey := &bytes.Buffer{}
+	aw := armor.NewWriter(encKey)
+	w, _ := age.Encrypt(aw, recipient)
+	w.Write(key)
+	w.Close()
+	aw.Close()
+
+	if mac == "" {
+		h := sha512.New()
+		for _, v := range []string{"s3cr3t", "admin", "5432", "True", "a", "b", "plain"} {
+			io.WriteString(h, v)
+		}
+		mac = fmt.Sprintf("%X", h.Sum(nil))
+	}
+
+	return fmt.Sprintf(`{
+	"db": {
+		"password": %q,
+		"user": %q,
+		"port": %q
+	},
+	"debug": %q,
+	"hosts": [%q, %q],
+	"note_unencrypted": "plain",
+	"sops": {
+		"age": [{"recipient": %q, "enc": %q}],
+		"lastmodified": %q,
+		"mac": %q,
+		"version": "3.7.3"
+	}
+}`,
+		sopsEncrypt(key, "s3cr3t", "str", "db:password:"),
+		sopsEncrypt(key, "admin", "str", "db:user:"),
+		sopsEncrypt(key, "5432", "int", "db:port:"),
+		sopsEncrypt(key, "True", "bool", "debug:"),
+		sopsEncrypt(key, "a", "str", "hosts:"),
+		sopsEncrypt(key, "b", "str", "hosts:"),
+		fmt.Sprint(recipient),
+		encKey.String(),
+		sopsLastModified,
+		sopsEncrypt(key, mac, "str", sopsLastModified))
+}
+
+func TestSOPSBackend(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sops-backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	identity, _ := age.GenerateX25519Identity()
+	identityPath := path.Join(tmpDir, "host.age")
+	ioutil.WriteFile(identityPath, []byte(identity.String()+"\n"), 0600)
+
+	decryptor, err := NewHostFileDecryptor(identityPath, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(path.Join(tmpDir, "app.json"), []byte(sopsDocumentFixture(t, identity.Recipient(), "")), 0600)
+
+	params := &options{Backend: sopsBackend, SecretsPath: "app.json"}
+	getter, _ := NewSOPSSecretGetter(tmpDir, params, decryptor)
+	secrets, err := getter.GetSecrets(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dstDir := path.Join(tmpDir, "dst")
+	os.MkdirAll(dstDir, 0755)
+
+	sw, _ := NewClearTextSecretWriter()
+	if err := sw.Write(secrets, dstDir); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"db.password":      "s3cr3t",
+		"db.user":          "admin",
+		"db.port":          "5432",
+		"debug":            "True",
+		"hosts.0":          "a",
+		"hosts.1":          "b",
+		"note_unencrypted": "plain",
+	}
+	if len(secrets) != len(expected) {
+		t.Errorf("Expected %d secrets, got %d", len(expected), len(secrets))
+	}
+	for name, value := range expected {
+		content, err := ioutil.ReadFile(path.Join(dstDir, name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(content) != value {
+			t.Errorf("Contents of file %s not equal. %s != %s", name, value, string(content))
+		}
+	}
+
+	ioutil.WriteFile(path.Join(tmpDir, "tampered.json"), []byte(sopsDocumentFixture(t, identity.Recipient(), strings.Repeat("0", 128))), 0600)
+	params.SecretsPath = "tampered.json"
+	getter, _ = NewSOPSSecretGetter(tmpDir, params, decryptor)
+	if _, err := getter.GetSecrets(params); err == nil || !strings.Contains(err.Error(), "MAC mismatch") {
+		t.Errorf("Expected MAC mismatch, got %v", err)
+	}
+}
+
+func TestSOPSKeysDoNotEscape(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	volume := path.Join(tmpDir, "volume")
+	if err := os.Mkdir(volume, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sw, _ := NewClearTextSecretWriter()
+	for _, name := range []string{"../escape", "a/b", "..", ""} {
+		s := secret{Name: name, RewrapText: base64.StdEncoding.EncodeToString([]byte("x"))}
+		if err := sw.Write([]secret{s}, volume); err == nil {
+			t.Errorf("Expected key %q to be rejected", name)
+		}
+	}
+
+	if _, err := os.Stat(path.Join(tmpDir, "escape")); !os.IsNotExist(err) {
+		t.Error("Secret written outside the volume")
+	}
+}
@@ -0,0 +1,115 @@
+package secrets
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+const stateFileSuffix = ".json"
+
+// stateStore persists small JSON records for the driver between invocations.
+// Each kind of record lives in its own directory and every invocation of the
+// driver is a separate process, so callers that read and then write must do
+// so under lock.
+type stateStore struct {
+	dir string
+}
+
+func newStateStore(dir string) *stateStore {
+	return &stateStore{
+		dir: dir,
+	}
+}
+
+// lock takes an exclusive host wide lock on the store and returns the func
+// to release it.
+func (s *stateStore) lock() (func(), error) {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path.Join(s.dir, ".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func (s *stateStore) file(kind, key string) string {
+	return path.Join(s.dir, kind, path.Base(key)+stateFileSuffix)
+}
+
+func (s *stateStore) get(kind, key string, v interface{}) error {
+	data, err := ioutil.ReadFile(s.file(kind, key))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *stateStore) put(kind, key string, v interface{}) error {
+	dir := path.Join(s.dir, kind)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.file(kind, key))
+}
+
+func (s *stateStore) remove(kind, key string) error {
+	err := os.Remove(s.file(kind, key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *stateStore) list(kind string) ([]string, error) {
+	files, err := ioutil.ReadDir(path.Join(s.dir, kind))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, fi := range files {
+		if strings.HasPrefix(fi.Name(), ".") || !strings.HasSuffix(fi.Name(), stateFileSuffix) {
+			continue
+		}
+		keys = append(keys, strings.TrimSuffix(fi.Name(), stateFileSuffix))
+	}
+	return keys, nil
+}
@@ -0,0 +1,257 @@
+package secrets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/urfave/cli"
+)
+
+// volumeStatus joins what the driver recorded at attach with what the mount
+// table says now. Recorded is false for staged volumes without a record, for
+// example those attached by an older version of the driver.
+type volumeStatus struct {
+	volumeRecord
+	Recorded bool     `json:"recorded"`
+	Mounted  bool     `json:"mounted"`
+	FSType   string   `json:"fsType,omitempty"`
+	Targets  []string `json:"targets"`
+}
+
+// ListCommand lists the volumes staged on this host.
+func ListCommand() cli.Command {
+	return cli.Command{
+		Name:  "list",
+		Usage: "List the secret volumes staged on this host",
+		Flags: []cli.Flag{
+			cli.BoolFlag{Name: "json", Usage: "print JSON instead of a table"},
+		},
+		Action: listVols,
+	}
+}
+
+// StatusCommand shows a single staged volume and its secrets, never their
+// content.
+func StatusCommand() cli.Command {
+	return cli.Command{
+		Name:      "status",
+		Usage:     "Show a secret volume, its mounts and the hashes of its secrets",
+		ArgsUsage: "VOLUME",
+		Flags: []cli.Flag{
+			cli.BoolFlag{Name: "json", Usage: "print JSON instead of a table"},
+		},
+		Action: statusVol,
+	}
+}
+
+func listVols(c *cli.Context) error {
+	cfg := defaultHostConfig()
+	statuses, err := volumeStatuses(cfg.stagingDir, newStateStore(cfg.stateDir), hostMounter)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		return printJSON(os.Stdout, statuses)
+	}
+	return printList(os.Stdout, statuses)
+}
+
+func statusVol(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("Exactly one volume name is required")
+	}
+	name := c.Args().First()
+
+	cfg := defaultHostConfig()
+	statuses, err := volumeStatuses(cfg.stagingDir, newStateStore(cfg.stateDir), hostMounter)
+	if err != nil {
+		return err
+	}
+
+	for _, status := range statuses {
+		if status.Name == name {
+			if c.Bool("json") {
+				return printJSON(os.Stdout, status)
+			}
+			return printStatus(os.Stdout, status)
+		}
+	}
+
+	return fmt.Errorf("Volume %s not found", name)
+}
+
+// volumeStatuses reports every volume that is either staged below stagingDir
+// or recorded in the store, sorted by name.
+func volumeStatuses(stagingDir string, store *stateStore, mounter Mounter) ([]volumeStatus, error) {
+	names := map[string]bool{}
+
+	files, err := ioutil.ReadDir(stagingDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fi := range files {
+		if fi.IsDir() {
+			names[fi.Name()] = true
+		}
+	}
+
+	keys, err := store.list(volumeStateKind)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		names[key] = true
+	}
+
+	mounts, err := mounter.GetMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []volumeStatus{}
+	for name := range names {
+		status := volumeStatus{
+			volumeRecord: volumeRecord{
+				Name:    name,
+				Device:  path.Join(stagingDir, name),
+				Secrets: []secretRecord{},
+			},
+			Targets: []string{},
+		}
+
+		record := volumeRecord{}
+		if err := store.get(volumeStateKind, name, &record); err == nil {
+			status.volumeRecord = record
+			status.Recorded = true
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		status.setMounts(mounts)
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	return statuses, nil
+}
+
+// setMounts finds the staging mount of the volume and the bind mounts of it,
+// which share its device numbers.
+func (s *volumeStatus) setMounts(mounts []*mount.Info) {
+	var staging *mount.Info
+	for _, m := range mounts {
+		if m.Mountpoint == s.Device {
+			staging = m
+		}
+	}
+	if staging == nil {
+		return
+	}
+
+	s.Mounted = true
+	s.FSType = staging.Fstype
+
+	for _, m := range mounts {
+		if m.Mountpoint != s.Device && m.Major == staging.Major && m.Minor == staging.Minor {
+			s.Targets = append(s.Targets, m.Mountpoint)
+		}
+	}
+	sort.Strings(s.Targets)
+}
+
+// volumeForTarget returns the volume staged below stagingDir that is bind
+// mounted on dir, empty if there is none.
+func volumeForTarget(mounter Mounter, stagingDir, dir string) string {
+	mounts, err := mounter.GetMounts()
+	if err != nil {
+		return ""
+	}
+
+	for _, target := range mounts {
+		if target.Mountpoint != dir {
+			continue
+		}
+		for _, m := range mounts {
+			if path.Dir(m.Mountpoint) == stagingDir && m.Major == target.Major && m.Minor == target.Minor {
+				return path.Base(m.Mountpoint)
+			}
+		}
+	}
+	return ""
+}
+
+func printJSON(out io.Writer, v interface{}) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printList(out io.Writer, statuses []volumeStatus) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tBACKEND\tMEDIUM\tMOUNTED\tSECRETS\tTARGETS\tATTACHED")
+
+	for _, s := range statuses {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%d\t%d\t%s\n", s.Name, orDash(s.Backend), orDash(s.FSType),
+			s.Mounted, len(s.Secrets), len(s.Targets), attachedAt(s))
+	}
+
+	return w.Flush()
+}
+
+func printStatus(out io.Writer, s volumeStatus) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Name:\t%s\n", s.Name)
+	fmt.Fprintf(w, "Device:\t%s\n", s.Device)
+	fmt.Fprintf(w, "Backend:\t%s\n", orDash(s.Backend))
+	fmt.Fprintf(w, "Mounted:\t%t\n", s.Mounted)
+	fmt.Fprintf(w, "Filesystem:\t%s\n", orDash(s.FSType))
+	fmt.Fprintf(w, "Attached:\t%s\n", attachedAt(s))
+	if s.PodUID != "" {
+		fmt.Fprintf(w, "Pod:\t%s/%s (%s)\n", s.PodNamespace, s.PodName, s.PodUID)
+	}
+	fmt.Fprintf(w, "Targets:\t%s\n", orDash(strings.Join(s.Targets, ", ")))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(s.Secrets) == 0 {
+		return nil
+	}
+
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SECRET\tMODE\tUID\tGID\tSHA256")
+	for _, secret := range s.Secrets {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", secret.Name, secret.Mode, secret.UID, secret.GID, secret.SHA256)
+	}
+	return w.Flush()
+}
+
+func attachedAt(s volumeStatus) string {
+	if !s.Recorded {
+		return "-"
+	}
+	return s.AttachedAt.Local().Format(time.RFC3339)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
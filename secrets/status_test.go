@@ -0,0 +1,77 @@
+package secrets
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestVolumeStatuses(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	staging := path.Join(tmpDir, "staging")
+	store := newStateStore(path.Join(tmpDir, "state"))
+
+	os.MkdirAll(path.Join(staging, "vol"), 0755)
+	os.MkdirAll(path.Join(staging, "old"), 0755)
+	ioutil.WriteFile(path.Join(staging, "vol", "db_password"), []byte("hunter2"), 0444)
+
+	options := &options{Name: "vol", Backend: fileBackend, Medium: tmpfsMedium}
+	record, err := newVolumeRecord(options, path.Join(staging, "vol"), []secret{{Name: "db_password"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := recordVolume(store, record); err != nil {
+		t.Fatal(err)
+	}
+
+	mounter := newFakeMounter()
+	mounter.Mount(tmpfsMedium, path.Join(staging, "vol"), tmpfsMedium, "size=1m")
+	mounter.Mount(path.Join(staging, "vol"), "/var/lib/kubelet/pods/abc/volumes/secrets", "none", "bind,rw")
+	mounter.Mount(tmpfsMedium, "/dev/shm", tmpfsMedium, "")
+
+	statuses, err := volumeStatuses(staging, store, mounter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(statuses) != 2 || statuses[0].Name != "old" || statuses[1].Name != "vol" {
+		t.Fatalf("Unexpected volumes: %v", statuses)
+	}
+
+	if statuses[0].Recorded || statuses[0].Mounted {
+		t.Errorf("Unexpected status for unrecorded volume: %v", statuses[0])
+	}
+
+	vol := statuses[1]
+	if !vol.Recorded || !vol.Mounted || vol.Backend != fileBackend || len(vol.Targets) != 1 {
+		t.Errorf("Unexpected status: %v", vol)
+	}
+
+	// sha256 of hunter2
+	if len(vol.Secrets) != 1 || vol.Secrets[0].SHA256 != "f52fbd32b2b3b86ff88ef6c490628285f482af15ddcb29541f94bcf526a3f6c7" {
+		t.Errorf("Unexpected secrets: %v", vol.Secrets)
+	}
+
+	out := &bytes.Buffer{}
+	if err := printStatus(out, vol); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "hunter2") {
+		t.Error("Status must not contain secret content")
+	}
+
+	if err := forgetVolume(store, path.Join(staging, "vol")); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := store.list(volumeStateKind); len(keys) != 0 {
+		t.Errorf("Volume not forgotten: %v", keys)
+	}
+}
@@ -0,0 +1,80 @@
+package secrets
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	swapAllow  = "allow"
+	swapWarn   = "warn"
+	swapRefuse = "refuse"
+)
+
+var (
+	swapsPath = "/proc/swaps"
+
+	lockMemory = func() error {
+		return syscall.Mlockall(syscall.MCL_CURRENT | syscall.MCL_FUTURE)
+	}
+)
+
+// swapActive reports whether any swap device is in use on the host
+func swapActive() (bool, error) {
+	f, err := os.Open(swapsPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) != "" {
+			lines++
+		}
+	}
+
+	// The first line is the header
+	return lines > 1, scanner.Err()
+}
+
+// checkSwap applies the swap policy of the volume. tmpfs pages can be
+// swapped so with swap active the volume is refused or a warning is logged.
+// The driver process itself is locked in memory either way so decrypted keys
+// never reach swap.
+func checkSwap(options *options) error {
+	active, err := swapActive()
+	if err != nil {
+		logrus.Warnf("Could not determine if swap is active: %v", err)
+		return nil
+	}
+	if !active {
+		return nil
+	}
+
+	if err := lockMemory(); err != nil {
+		logrus.Warnf("Swap is active and the driver could not lock its memory: %v", err)
+	}
+
+	if options.Medium == ramfsMedium {
+		return nil
+	}
+
+	switch options.Swap {
+	case swapRefuse:
+		return errors.New("Swap is active on this host, refusing to write secrets to tmpfs. Use medium ramfs or disable swap")
+	case swapAllow:
+	default:
+		logrus.Warnf("Swap is active on this host, secrets in volume %s may be written to disk. Consider medium ramfs", options.Name)
+	}
+
+	return nil
+}
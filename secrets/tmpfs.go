@@ -0,0 +1,151 @@
+package secrets
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// tmpfsGenerations leaves room for the current set of secrets plus new
+	// generations being written next to it during an atomic update.
+	tmpfsGenerations = 3
+	tmpfsPageSize    = 4096
+	minTmpfsSize     = 1024 * 1024
+	minTmpfsInodes   = 64
+	// defaultTmpfsSize is used when the secrets are not known up front
+	defaultTmpfsSize = "10m"
+)
+
+// enforcedMountOpts are always applied to the secrets tmpfs
+var enforcedMountOpts = []string{"noexec", "nosuid", "nodev"}
+
+// safeMountFlags may be passed in mountOpts, anything else, notably exec,
+// suid and dev, is rejected.
+var safeMountFlags = map[string]bool{
+	"noexec":      true,
+	"nosuid":      true,
+	"nodev":       true,
+	"ro":          true,
+	"rw":          true,
+	"noatime":     true,
+	"nodiratime":  true,
+	"relatime":    true,
+	"strictatime": true,
+	"sync":        true,
+	"async":       true,
+}
+
+// safeMountKeys are tmpfs options taking a value
+var safeMountKeys = map[string]bool{
+	"size":      true,
+	"nr_blocks": true,
+	"nr_inodes": true,
+	"mode":      true,
+	"uid":       true,
+	"gid":       true,
+	"mpol":      true,
+	"huge":      true,
+}
+
+func isSafeMountOpts(v string) error {
+	for _, opt := range splitList(v) {
+		key := opt
+		if i := strings.Index(opt, "="); i >= 0 {
+			key = opt[:i]
+			if !safeMountKeys[key] {
+				return fmt.Errorf("mount option %s is not allowed", opt)
+			}
+			continue
+		}
+		if !safeMountFlags[key] {
+			return fmt.Errorf("mount option %s is not allowed", opt)
+		}
+	}
+	return nil
+}
+
+// tmpfsMountOptions builds the tmpfs mount options for a volume. Explicit
+// limits win over those in mountOpts, which win over defaults sized from the
+// secrets, and the mode option applies unless mountOpts sets one. A nil
+// secrets slice means the content is not known yet.
+func tmpfsMountOptions(options *options, secrets []secret) (string, error) {
+	if err := isSafeMountOpts(options.MountOpts); err != nil {
+		return "", &OptionError{Option: "mountOpts", Value: options.MountOpts, Reason: err.Error()}
+	}
+
+	opts := []string{}
+	keyed := map[string]int{}
+	for _, opt := range splitList(options.MountOpts) {
+		if i := strings.Index(opt, "="); i >= 0 {
+			keyed[opt[:i]] = len(opts)
+		}
+		opts = append(opts, opt)
+	}
+
+	set := func(key, value string, override bool) {
+		if i, ok := keyed[key]; ok {
+			if override {
+				opts[i] = key + "=" + value
+			}
+			return
+		}
+		keyed[key] = len(opts)
+		opts = append(opts, key+"="+value)
+	}
+
+	size, inodes := defaultTmpfsLimits(secrets)
+
+	if options.SizeLimit != "" {
+		set("size", options.SizeLimit, true)
+	} else {
+		set("size", size, false)
+	}
+
+	if options.InodeLimit != "" {
+		set("nr_inodes", options.InodeLimit, true)
+	} else if inodes != "" {
+		set("nr_inodes", inodes, false)
+	}
+
+	// Without it the root of the tmpfs is 1777 whatever mode asked for
+	set("mode", fmt.Sprintf("%04o", options.Mode), false)
+
+	for _, flag := range enforcedMountOpts {
+		found := false
+		for _, opt := range opts {
+			found = found || opt == flag
+		}
+		if !found {
+			opts = append(opts, flag)
+		}
+	}
+
+	return strings.Join(opts, ","), nil
+}
+
+// defaultTmpfsLimits sizes the tmpfs from the secrets. RewrapText is always
+// larger than the content it decrypts to so it is a safe upper bound, every
+// file takes at least a page.
+func defaultTmpfsLimits(secrets []secret) (string, string) {
+	if secrets == nil {
+		return defaultTmpfsSize, ""
+	}
+
+	size := 0
+	for _, s := range secrets {
+		pages := (len(s.RewrapText) + len(s.clearText) + tmpfsPageSize - 1) / tmpfsPageSize
+		if pages == 0 {
+			pages = 1
+		}
+		size += pages * tmpfsPageSize
+	}
+	size *= tmpfsGenerations
+	if size < minTmpfsSize {
+		size = minTmpfsSize
+	}
+
+	inodes := len(secrets)*tmpfsGenerations + minTmpfsInodes
+
+	return strconv.Itoa((size+1023)/1024) + "k", strconv.Itoa(inodes)
+}
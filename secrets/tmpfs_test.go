@@ -0,0 +1,41 @@
+package secrets
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTmpfsMountOptions(t *testing.T) {
+	big := secret{Name: "big", RewrapText: strings.Repeat("a", 1024*1024+1)}
+
+	tests := []struct {
+		options  *options
+		secrets  []secret
+		expected string
+	}{
+		{&options{Mode: 0755}, nil, "size=10m,mode=0755,noexec,nosuid,nodev"},
+		{&options{Mode: 0750}, tGet.Data, "size=1024k,nr_inodes=70,mode=0750,noexec,nosuid,nodev"},
+		{&options{Mode: 0755}, []secret{big}, "size=3084k,nr_inodes=67,mode=0755,noexec,nosuid,nodev"},
+		{&options{SizeLimit: "2m", InodeLimit: "10", Mode: 0755}, tGet.Data, "size=2m,nr_inodes=10,mode=0755,noexec,nosuid,nodev"},
+		{&options{MountOpts: "size=5m,noatime,nodev", Mode: 0755}, tGet.Data, "size=5m,noatime,nodev,nr_inodes=70,mode=0755,noexec,nosuid"},
+		{&options{MountOpts: "size=5m", SizeLimit: "6m", Mode: 0755}, nil, "size=6m,mode=0755,noexec,nosuid,nodev"},
+		{&options{MountOpts: "mode=0700", Mode: 0755}, nil, "mode=0700,size=10m,noexec,nosuid,nodev"},
+	}
+
+	for _, test := range tests {
+		mountOpts, err := tmpfsMountOptions(test.options, test.secrets)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if mountOpts != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, mountOpts)
+		}
+	}
+
+	for _, unsafe := range []string{"exec", "suid", "dev", "size=1m,dev", "bind", "remount"} {
+		if _, err := tmpfsMountOptions(&options{MountOpts: unsafe}, nil); err == nil {
+			t.Errorf("Expected mountOpts %s to be rejected", unsafe)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package secrets
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	tokenStateKind = "tokens"
+	tokenRecordTTL = 24 * time.Hour
+)
+
+type tokenRecord struct {
+	Fingerprint string    `json:"fingerprint"`
+	Volume      string    `json:"volume"`
+	Owner       string    `json:"owner"`
+	FirstUsed   time.Time `json:"firstUsed"`
+	LastUsed    time.Time `json:"lastUsed"`
+	Expires     time.Time `json:"expires"`
+}
+
+func tokenFingerprint(token *secretToken) string {
+	sum := sha256.Sum256(token.Value)
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenOwner identifies who a token was consumed for. A restarted container
+// re-attaching its own volume is the same owner.
+func tokenOwner(params *options) string {
+	if params.PodUID != "" {
+		return "pod:" + params.PodUID
+	}
+	return "volume:" + params.Name
+}
+
+// claimToken records that the token has been used for this volume and owner,
+// failing if it was already used by a different one. Expired records are
+// dropped on the way.
+func claimToken(store *stateStore, params *options) error {
+	if params.Token == nil {
+		return nil
+	}
+
+	unlock, err := store.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	pruneTokens(store)
+
+	now := time.Now().UTC()
+	fingerprint := tokenFingerprint(params.Token)
+	owner := tokenOwner(params)
+
+	record := &tokenRecord{}
+	err = store.get(tokenStateKind, fingerprint, record)
+	switch {
+	case os.IsNotExist(err):
+		record = &tokenRecord{
+			Fingerprint: fingerprint,
+			Volume:      params.Name,
+			Owner:       owner,
+			FirstUsed:   now,
+		}
+	case err != nil:
+		return err
+	case record.Owner != owner || record.Volume != params.Name:
+		logrus.Warnf("Refusing replayed token %s..., first used at %s by %s for volume %s", fingerprint[:12], record.FirstUsed.Format(time.RFC3339), record.Owner, record.Volume)
+		return fmt.Errorf("Secrets token has already been used for another volume")
+	}
+
+	record.LastUsed = now
+	record.Expires = now.Add(tokenRecordTTL)
+
+	return store.put(tokenStateKind, fingerprint, record)
+}
+
+func pruneTokens(store *stateStore) {
+	keys, err := store.list(tokenStateKind)
+	if err != nil {
+		logrus.Warnf("Failed to list token records: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		record := &tokenRecord{}
+		if err := store.get(tokenStateKind, key, record); err != nil || now.After(record.Expires) {
+			store.remove(tokenStateKind, key)
+		}
+	}
+}
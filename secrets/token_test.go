@@ -0,0 +1,50 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClaimToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := newStateStore(dir)
+	token := &secretToken{Value: []byte("onetime")}
+
+	first := &options{Name: "vol", PodUID: "pod-1", Token: token}
+	if err := claimToken(store, first); err != nil {
+		t.Fatal(err)
+	}
+
+	// Re-attach for the same pod, e.g. a container restart
+	if err := claimToken(store, first); err != nil {
+		t.Errorf("Expected same owner to re-use token, got %v", err)
+	}
+
+	replay := &options{Name: "vol", PodUID: "pod-2", Token: token}
+	if err := claimToken(store, replay); err == nil {
+		t.Error("Expected token replay for another pod to be refused")
+	}
+
+	keys, _ := store.list(tokenStateKind)
+	if len(keys) != 1 || strings.Contains(keys[0], "onetime") || keys[0] != tokenFingerprint(token) {
+		t.Errorf("Expected a single fingerprinted record, got %v", keys)
+	}
+
+	// Expired records no longer block the token
+	record := &tokenRecord{}
+	store.get(tokenStateKind, keys[0], record)
+	record.Expires = time.Now().Add(-time.Minute)
+	store.put(tokenStateKind, keys[0], record)
+
+	if err := claimToken(store, replay); err != nil {
+		t.Errorf("Expected expired record to be pruned, got %v", err)
+	}
+}
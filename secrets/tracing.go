@@ -0,0 +1,367 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	tracingServiceName = "secrets-flexvol"
+	tracingScope       = "github.com/rancher/secrets-flexvol"
+	traceparentHeader  = "traceparent"
+
+	// OTLP span kinds and status codes
+	spanKindInternal = 1
+	spanKindClient   = 3
+	statusOK         = 1
+	statusError      = 2
+)
+
+var (
+	// activeTracer collects the spans of the current driver call, nil when
+	// tracing is disabled. Driver calls are serialized within a process, so
+	// spans nest by the order they are started and ended in.
+	activeTracer *tracer
+
+	// callerTraceparent is the trace context the driver was called with,
+	// forwarded to the daemon
+	callerTraceparent string
+
+	traceparentFormat = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+)
+
+// TracingFlags are the global flags configuring tracing
+func TracingFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "otlp-endpoint", EnvVar: "SECRETS_FLEXVOL_OTLP_ENDPOINT,OTEL_EXPORTER_OTLP_ENDPOINT", Usage: "OTLP/HTTP collector to export traces to, e.g. http://localhost:4318"},
+		cli.StringFlag{Name: "traceparent", EnvVar: "TRACEPARENT", Usage: "W3C trace context to continue"},
+	}
+}
+
+// SetupTracing enables tracing when a collector is configured
+func SetupTracing(c *cli.Context) error {
+	callerTraceparent = c.GlobalString("traceparent")
+
+	endpoint := c.GlobalString("otlp-endpoint")
+	if endpoint == "" {
+		return nil
+	}
+
+	t, err := newTracer(endpoint, c.GlobalString("traceparent"))
+	if err != nil {
+		return err
+	}
+	activeTracer = t
+	return nil
+}
+
+type tracer struct {
+	mu            sync.Mutex
+	endpoint      string
+	client        *http.Client
+	remoteTraceID string
+	remoteParent  string
+	stack         []*span
+	finished      []*span
+}
+
+type span struct {
+	tracer     *tracer
+	traceID    string
+	id         string
+	parentID   string
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        error
+}
+
+// newTracer exports to the OTLP/HTTP endpoint, continuing the trace of
+// traceparent if one is given. Otherwise every span started without open
+// spans starts a trace of its own.
+func newTracer(endpoint, traceparent string) (*tracer, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+
+	t := &tracer{
+		endpoint: u.String(),
+		client:   &http.Client{Timeout: 2 * time.Second},
+	}
+
+	if traceparent != "" {
+		m := traceparentFormat.FindStringSubmatch(traceparent)
+		if m == nil {
+			return nil, fmt.Errorf("Invalid traceparent %q", traceparent)
+		}
+		t.remoteTraceID, t.remoteParent = m[1], m[2]
+	}
+
+	return t, nil
+}
+
+// continueTrace makes spans started without open spans continue the trace
+// of traceparent, or start traces of their own when it is empty or invalid.
+// It returns the func restoring the trace context it replaced.
+func (t *tracer) continueTrace(traceparent string) func() {
+	if t == nil {
+		return func() {}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prevTraceID, prevParent := t.remoteTraceID, t.remoteParent
+	t.remoteTraceID, t.remoteParent = "", ""
+	if m := traceparentFormat.FindStringSubmatch(traceparent); m != nil {
+		t.remoteTraceID, t.remoteParent = m[1], m[2]
+	} else if traceparent != "" {
+		logrus.Warnf("Ignoring invalid traceparent %q", traceparent)
+	}
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.remoteTraceID, t.remoteParent = prevTraceID, prevParent
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startSpan starts a child of the innermost open span. It returns nil, on
+// which all span methods are no-ops, when tracing is disabled.
+func startSpan(name string) *span {
+	return activeTracer.start(nil, name, spanKindInternal)
+}
+
+// startSpanIn starts a child of parent, or of the innermost open span when
+// parent is nil. The open spans are shared by the process, so code running
+// concurrently, like the getters of a composite, passes its parent
+// explicitly.
+func startSpanIn(parent *span, name string, kind int) *span {
+	if parent != nil {
+		return parent.tracer.start(parent, name, kind)
+	}
+	return activeTracer.start(nil, name, kind)
+}
+
+// currentSpan returns the innermost open span, nil when there is none
+func currentSpan() *span {
+	t := activeTracer
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.stack) == 0 {
+		return nil
+	}
+	return t.stack[len(t.stack)-1]
+}
+
+// start opens a span. Spans with an explicit parent are kept off the stack
+// of open spans, their parent holds back the export until it ends.
+func (t *tracer) start(parent *span, name string, kind int) *span {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := &span{
+		tracer:     t,
+		traceID:    t.remoteTraceID,
+		id:         randomHex(8),
+		parentID:   t.remoteParent,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: map[string]string{},
+	}
+	switch {
+	case parent != nil:
+		s.traceID, s.parentID = parent.traceID, parent.id
+		return s
+	case len(t.stack) > 0:
+		top := t.stack[len(t.stack)-1]
+		s.traceID, s.parentID = top.traceID, top.id
+	case s.traceID == "":
+		s.traceID = randomHex(16)
+	}
+	t.stack = append(t.stack, s)
+
+	return s
+}
+
+func (s *span) setAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// traceparent returns the W3C trace context header of the span for requests
+// made within it.
+func (s *span) traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", s.traceID, s.id)
+}
+
+// finish ends the span with the outcome of err. Ending the last open span
+// exports the trace.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+
+	t := s.tracer
+	t.mu.Lock()
+	s.end = time.Now()
+	s.err = err
+	for i := len(t.stack) - 1; i >= 0; i-- {
+		if t.stack[i] == s {
+			t.stack = append(t.stack[:i], t.stack[i+1:]...)
+			break
+		}
+	}
+	t.finished = append(t.finished, s)
+
+	var spans []*span
+	if len(t.stack) == 0 {
+		spans, t.finished = t.finished, nil
+	}
+	t.mu.Unlock()
+
+	if len(spans) > 0 {
+		if err := t.export(spans); err != nil {
+			logrus.Warnf("Failed to export trace: %v", err)
+		}
+	}
+}
+
+// export posts spans as OTLP/HTTP JSON
+func (t *tracer) export(spans []*span) error {
+	otlpSpans := []map[string]interface{}{}
+	for _, s := range spans {
+		attributes := []map[string]interface{}{}
+		for k, v := range s.attributes {
+			attributes = append(attributes, otlpAttribute(k, v))
+		}
+
+		status := map[string]interface{}{"code": statusOK}
+		if s.err != nil {
+			status = map[string]interface{}{"code": statusError, "message": logRedactor.scrub(s.err.Error())}
+		}
+
+		otlpSpan := map[string]interface{}{
+			"traceId":           s.traceID,
+			"spanId":            s.id,
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": fmt.Sprint(s.start.UnixNano()),
+			"endTimeUnixNano":   fmt.Sprint(s.end.UnixNano()),
+			"attributes":        attributes,
+			"status":            status,
+		}
+		if s.parentID != "" {
+			otlpSpan["parentSpanId"] = s.parentID
+		}
+		otlpSpans = append(otlpSpans, otlpSpan)
+	}
+
+	host, _ := os.Hostname()
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []interface{}{
+						otlpAttribute("service.name", tracingServiceName),
+						otlpAttribute("host.name", host),
+					},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": tracingScope},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+func otlpAttribute(key, value string) map[string]interface{} {
+	return map[string]interface{}{
+		"key":   key,
+		"value": map[string]interface{}{"stringValue": value},
+	}
+}
+
+// tracedDecryptor records a span for every decryption, as a child of parent
+// when set.
+type tracedDecryptor struct {
+	Decryptor
+	backend string
+	parent  *span
+}
+
+func (t tracedDecryptor) Decrypt(cipherText string) ([]byte, error) {
+	s := startSpanIn(t.parent, "Decrypt", spanKindInternal)
+	s.setAttribute("backend", t.backend)
+
+	clearText, err := t.Decryptor.Decrypt(cipherText)
+	s.finish(err)
+	return clearText, err
+}
+
+// decryptorIn returns decryptor with its spans started as children of parent,
+// for getters that decrypt while running concurrently.
+func decryptorIn(decryptor Decryptor, parent *span) Decryptor {
+	if t, ok := decryptor.(tracedDecryptor); ok && parent != nil {
+		t.parent = parent
+		return t
+	}
+	return decryptor
+}
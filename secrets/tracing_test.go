@@ -0,0 +1,191 @@
+package secrets
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type otlpRequest struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []struct {
+				TraceID      string `json:"traceId"`
+				SpanID       string `json:"spanId"`
+				ParentSpanID string `json:"parentSpanId"`
+				Name         string `json:"name"`
+				Status       struct {
+					Code    int    `json:"code"`
+					Message string `json:"message"`
+				} `json:"status"`
+			} `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func TestTracing(t *testing.T) {
+	exports := []otlpRequest{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("Unexpected collector path %s", r.URL.Path)
+		}
+		req := otlpRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		exports = append(exports, req)
+	}))
+	defer collector.Close()
+
+	var traceparent string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get(traceparentHeader)
+		w.Write([]byte("[]"))
+	}))
+	defer api.Close()
+
+	tr, err := newTracer(collector.URL, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(orig *tracer) { activeTracer = orig }(activeTracer)
+	activeTracer = tr
+
+	root := startSpan("attach")
+	fetch := startSpan("GetSecrets")
+	getter := rancherSecretGetter{url: api.URL, client: http.DefaultClient, token: &secretToken{Value: []byte("token")}}
+	if _, err := getter.GetSecrets(&options{}); err != nil {
+		t.Fatal(err)
+	}
+	fetch.finish(nil)
+
+	decryptor := tracedDecryptor{Decryptor: testDecryptor{}, backend: rancherBackend}
+	decryptor.Decrypt("")
+
+	if len(exports) != 0 {
+		t.Fatal("Trace exported before the root span ended")
+	}
+	root.finish(nil)
+
+	if len(exports) != 1 {
+		t.Fatalf("Expected one export, got %d", len(exports))
+	}
+
+	spans := map[string]string{}
+	ids := map[string]string{}
+	for _, s := range exports[0].ResourceSpans[0].ScopeSpans[0].Spans {
+		if s.TraceID != "0af7651916cd43dd8448eb211c80319c" {
+			t.Errorf("Span %s not in the parent trace: %s", s.Name, s.TraceID)
+		}
+		spans[s.Name] = s.ParentSpanID
+		ids[s.Name] = s.SpanID
+		if s.Name == "Decrypt" && (s.Status.Code != statusError || s.Status.Message == "") {
+			t.Errorf("Unexpected Decrypt status: %+v", s.Status)
+		}
+	}
+
+	if spans["attach"] != "b7ad6b7169203331" || spans["GetSecrets"] != ids["attach"] ||
+		spans["POST /secrets"] != ids["GetSecrets"] || spans["Decrypt"] != ids["attach"] {
+		t.Errorf("Unexpected span tree: parents %v, ids %v", spans, ids)
+	}
+
+	if !strings.HasSuffix(traceparent, ids["POST /secrets"]+"-01") {
+		t.Errorf("Unexpected traceparent sent to the secrets API: %s", traceparent)
+	}
+}
+
+func TestTracingComposite(t *testing.T) {
+	exports := []otlpRequest{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := otlpRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		exports = append(exports, req)
+	}))
+	defer collector.Close()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer api.Close()
+
+	tr, err := newTracer(collector.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(orig *tracer) { activeTracer = orig }(activeTracer)
+	activeTracer = tr
+
+	getter := rancherSecretGetter{url: api.URL, client: http.DefaultClient, token: &secretToken{Value: []byte("token")}}
+	composite, _ := NewCompositeSecretGetter([]string{"a", "b"}, []SecretGetter{getter, getter}, "")
+
+	root := startSpan("attach")
+	if _, err := composite.GetSecrets(&options{}); err != nil {
+		t.Fatal(err)
+	}
+	root.finish(nil)
+
+	if len(exports) != 1 {
+		t.Fatalf("Expected one export, got %d", len(exports))
+	}
+
+	parents := map[string]string{}
+	posts := []string{}
+	for _, s := range exports[0].ResourceSpans[0].ScopeSpans[0].Spans {
+		parents[s.SpanID] = s.ParentSpanID
+		if s.Name == "POST /secrets" {
+			posts = append(posts, s.SpanID)
+		}
+	}
+
+	if len(posts) != 2 || parents[posts[0]] == parents[posts[1]] {
+		t.Fatalf("Expected each request under its own getter span: %v", parents)
+	}
+	for _, id := range posts {
+		if parents[parents[id]] != root.id {
+			t.Errorf("Expected the getter span of %s under the root span: %v", id, parents)
+		}
+	}
+}
+
+func TestTracingRoots(t *testing.T) {
+	tr, err := newTracer("http://localhost:4318", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.client = &http.Client{Transport: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	})}
+
+	first := tr.start(nil, "attach", spanKindInternal)
+	child := tr.start(nil, "GetSecrets", spanKindInternal)
+	child.finish(nil)
+	first.finish(nil)
+	second := tr.start(nil, "attach", spanKindInternal)
+	second.finish(nil)
+
+	if child.traceID != first.traceID || second.traceID == first.traceID {
+		t.Errorf("Expected a trace per root span, got %s, %s and %s", first.traceID, child.traceID, second.traceID)
+	}
+
+	restore := tr.continueTrace("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	remote := tr.start(nil, "attach", spanKindInternal)
+	remote.finish(nil)
+	restore()
+	after := tr.start(nil, "attach", spanKindInternal)
+	after.finish(nil)
+
+	if remote.traceID != "0af7651916cd43dd8448eb211c80319c" || remote.parentID != "b7ad6b7169203331" {
+		t.Errorf("Expected the remote trace to be continued, got %s %s", remote.traceID, remote.parentID)
+	}
+	if after.traceID == remote.traceID || after.parentID != "" {
+		t.Errorf("Expected the remote trace to end with the call, got %s %s", after.traceID, after.parentID)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
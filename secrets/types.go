@@ -3,11 +3,9 @@ package secrets
 import (
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"net/http"
-	"strings"
-
-	"github.com/Sirupsen/logrus"
+	"os"
+	"time"
 )
 
 const (
@@ -19,12 +17,24 @@ const (
 	DefaultGID = "0"
 )
 
+// Secret is a secret as returned by a SecretGetter
+type Secret = secret
+
 type secret struct {
 	Name       string `json:"name"`
 	UID        string `json:"uid"`
 	GID        string `json:"gid"`
 	Mode       string `json:"mode"`
 	RewrapText string `json:"rewrapText"`
+
+	// backend is set by the composite getter to route writes
+	backend string
+	// clearText is set by getters that decrypt themselves, like SOPS
+	clearText []byte
+	// maxSize is set by a cappedSecretWriter to what is left of its limit
+	maxSize int64
+	// capture is set by a memorySecretWriter to keep the content off disk
+	capture func(file renderedFile)
 }
 
 type encryptedData struct {
@@ -41,11 +51,42 @@ type rsaEncryptedData struct {
 	HashAlgorithm       string `json:"hashAlgorithm,omitempty"`
 }
 
+// Options are the decoded options of a volume
+type Options = options
+
 type options struct {
-	Token   *secretToken `json:"io.rancher.secrets.token,omitempty"`
-	Rancher bool         `json:"rancher,string,omitempty"`
-	Device  string       `json:"device,omitempty"`
-	Name    string       `json:"name,omitempty"`
+	Token       *secretToken `json:"io.rancher.secrets.token,omitempty"`
+	Rancher     bool         `json:"rancher,string,omitempty"`
+	Device      string       `json:"device,omitempty"`
+	Name        string       `json:"name,omitempty"`
+	Backend     string       `json:"backend,omitempty"`
+	SecretsPath string       `json:"secretsPath,omitempty"`
+
+	Backends       string `json:"backends,omitempty"`
+	ConflictPolicy string `json:"conflictPolicy,omitempty"`
+
+	CacheTTL      string `json:"cacheTTL,omitempty"`
+	CacheMaxStale string `json:"cacheMaxStale,omitempty"`
+
+	Mode       os.FileMode `json:"mode,omitempty"`
+	SizeLimit  string      `json:"sizeLimit,omitempty"`
+	InodeLimit string      `json:"inodeLimit,omitempty"`
+	MountOpts  string      `json:"mountOpts,omitempty"`
+	Medium     string      `json:"medium,omitempty"`
+	Swap       string      `json:"swap,omitempty"`
+	Items      []string    `json:"items,omitempty"`
+	ReadOnly   bool        `json:"readOnly,omitempty"`
+	ReadWrite  string      `json:"kubernetes.io/readwrite,omitempty"`
+
+	PodName      string `json:"kubernetes.io/pod.name,omitempty"`
+	PodNamespace string `json:"kubernetes.io/pod.namespace,omitempty"`
+	PodUID       string `json:"kubernetes.io/pod.uid,omitempty"`
+
+	ServiceAccount string `json:"kubernetes.io/serviceAccount.name,omitempty"`
+
+	// span is the parent of the spans a getter starts, set by the composite
+	// getter which runs its getters concurrently
+	span *span
 }
 
 type secretToken struct {
@@ -74,48 +115,72 @@ type rsaSecretFileWriter struct {
 	decryptor Decryptor
 }
 
-func getEncryptedData(data string) (*encryptedData, error) {
-	encData := &encryptedData{}
+type cachingSecretGetter struct {
+	getter   SecretGetter
+	dir      string
+	key      string
+	ttl      time.Duration
+	maxStale time.Duration
+}
 
-	encDataDecoded, err := base64.StdEncoding.DecodeString(data)
-	if err != nil {
-		return encData, err
-	}
+type fileSecretGetter struct {
+	dir string
+}
 
-	err = json.Unmarshal(encDataDecoded, encData)
-	return encData, err
+type fileSecretWriter struct {
+	decryptor Decryptor
 }
 
-func newOptions(params map[string]interface{}) (*options, error) {
-	option := &options{}
-	token := &secretToken{}
+type sopsSecretGetter struct {
+	file      string
+	decryptor Decryptor
+}
 
-	//clean the token...
-	tkn, ok := params["io.rancher.secrets.token"].(string)
-	if !ok {
-		return option, errors.New("No token passed")
-	}
-	delete(params, "io.rancher.secrets.token")
-	token.Value, _ = clean([]byte(tkn))
+type clearTextSecretWriter struct{}
 
-	paramBytes, err := json.Marshal(params)
-	if err != nil {
-		return option, err
-	}
+type compositeSecretGetter struct {
+	names   []string
+	getters []SecretGetter
+	policy  string
+}
 
-	cParamBytes, _ := clean(paramBytes)
+type compositeSecretWriter struct {
+	writers map[string]SecretWriter
+}
 
-	err = json.Unmarshal(cParamBytes, option)
-	if err != nil {
-		logrus.Error(err)
-		return option, err
-	}
-	option.Token = token
+type cappedSecretWriter struct {
+	writer SecretWriter
+	limit  int64
+}
 
-	return option, nil
+type memorySecretWriter struct {
+	writer SecretWriter
+	files  []renderedFile
 }
 
-func clean(val []byte) ([]byte, error) {
-	stringToken := string(val)
-	return []byte(strings.Replace(stringToken, "\\", "", -1)), nil
+// renderedFile is a secret as it was or would be written into a volume
+type renderedFile struct {
+	Name     string
+	Size     int64
+	Mode     os.FileMode
+	UID      string
+	GID      string
+	Contents []byte
+}
+
+type hostFileDecryptor struct {
+	age     Decryptor
+	openPGP Decryptor
+}
+
+func getEncryptedData(data string) (*encryptedData, error) {
+	encData := &encryptedData{}
+
+	encDataDecoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return encData, err
+	}
+
+	err = json.Unmarshal(encDataDecoded, encData)
+	return encData, err
 }
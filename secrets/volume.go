@@ -2,21 +2,32 @@ package secrets
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"path"
-
-	"github.com/Sirupsen/logrus"
-	"github.com/docker/docker/pkg/mount"
+	"time"
 )
 
 const (
-	volRoot     = "/var/lib/rancher/volumes/rancher-secrets"
-	hostKeyPath = "/var/lib/rancher/etc/ssl/host.key"
+	volRoot             = "/var/lib/rancher/volumes/rancher-secrets"
+	hostKeyPath         = "/var/lib/rancher/etc/ssl/host.key"
+	hostAgeIdentityPath = "/var/lib/rancher/etc/ssl/host.age"
+	hostKeyringPath     = "/var/lib/rancher/etc/ssl/host.gpg"
+	fileSecretsRoot     = "/var/lib/rancher/secrets"
+
+	rancherBackend = "rancher"
+	fileBackend    = "file"
+	sopsBackend    = "sops"
 )
 
-// FlexVolume is a struct to implement the Rancher Volume interface
+// FlexVolume is a struct to implement the Rancher Volume interface. Use
+// NewFlexVolume to create one.
 type FlexVolume struct {
-	secretWriter SecretWriter
+	newGetter    SecretGetterFactory
+	newDecryptor DecryptorFactory
+	newWriter    SecretWriterFactory
+	mounter      Mounter
+	cfg          *hostConfig
 }
 
 // Init implements the flex volume interface and is a no-op at this time
@@ -25,24 +36,32 @@ func (sv *FlexVolume) Init() error {
 }
 
 // Create is implemented for Docker volume plugin API
-func (sv *FlexVolume) Create(options map[string]interface{}) (map[string]interface{}, error) {
-	resp := map[string]interface{}{}
-	if name, ok := options["name"].(string); ok {
-		volPath := path.Join(volRoot, "staging", name)
-
-		if err := createTmpfs(volPath, options); err != nil {
-			logrus.Error(err)
-			return resp, err
-		}
+func (sv *FlexVolume) Create(params map[string]interface{}) (resp map[string]interface{}, err error) {
+	log := newCallLog("create")
+	defer func() { sv.finish(log, nil, err) }()
+
+	resp = map[string]interface{}{}
+
+	options, err := decodeOptions(params)
+	if err != nil {
+		return resp, err
+	}
+	log.withOptions(options)
+
+	if options.Name == "" {
+		return resp, errors.New("Name not given")
+	}
 
-		resp["device"] = volPath
-		resp["name"] = name
+	volPath := path.Join(sv.config().stagingDir, options.Name)
 
-		return resp, nil
+	if err := createTmpfs(sv.getMounter(), volPath, options, nil); err != nil {
+		return resp, err
 	}
 
-	logrus.Error("Name not given as a string")
-	return resp, errors.New("Name not given")
+	resp["device"] = volPath
+	resp["name"] = options.Name
+
+	return resp, nil
 }
 
 // Delete is implemented for Docker volume plugin API it detaches the
@@ -55,93 +74,217 @@ func (sv *FlexVolume) Delete(options map[string]interface{}) error {
 }
 
 // Attach is implemeneted as a no-op for the flexvolume API
-func (sv *FlexVolume) Attach(params map[string]interface{}) (string, error) {
+func (sv *FlexVolume) Attach(params map[string]interface{}) (device string, err error) {
+	log := newCallLog("attach")
+	event := newAuditEvent(auditAttach)
+	defer func() { sv.finish(log, event, err) }()
+
 	options, err := newOptions(params)
+	if err != nil {
+		return "", err
+	}
+	log.withOptions(options)
+	event.withOptions(options)
 
-	// func (sv *FlexVolume) Mount(params map[string]interface{}) (string, error) {
 	if options.Name == "" {
 		return "", errors.New("Volume Name not given")
 	}
 
-	volumeDevice := path.Join(volRoot, "staging", options.Name)
+	cfg := sv.config()
+	store := newStateStore(cfg.stateDir)
 
-	if err := createTmpfs(volumeDevice, params); err != nil {
-		logrus.Error(err)
+	if err := claimToken(store, options); err != nil {
 		return "", err
 	}
 
-	secretGetter, err := NewRancherSecretGetter(options)
+	if err := checkSwap(options); err != nil {
+		return "", err
+	}
+
+	secretGetter, secretWriter, err := sv.secretBackend(options, cfg)
 	if err != nil {
-		logrus.Error(err)
 		return "", err
 	}
 
+	fetchStart := time.Now()
+	fetchSpan := startSpan("GetSecrets")
+	fetchSpan.setAttribute("backend", event.Backend)
 	secrets, err := secretGetter.GetSecrets(options)
+	fetchSpan.finish(err)
+	observeFetch(event.Backend, time.Since(fetchStart))
 	if err != nil {
-		logrus.Error(err)
 		return "", err
 	}
+	logRedactor.addSecrets(secrets)
 
-	decryptor, err := NewRSADecryptor(hostKeyPath)
+	secrets, err = selectItems(secrets, options.Items)
 	if err != nil {
-		logrus.Error(err)
 		return "", err
 	}
+	event.withSecrets(secrets)
 
-	secretWriter, err := NewRSASecretFileWriter(decryptor)
-	if err != nil {
-		logrus.Error(err)
+	volumeDevice := path.Join(cfg.stagingDir, options.Name)
+	event.Device = volumeDevice
+
+	// The tmpfs is sized from the secrets so it is created once they are known
+	if err := createTmpfs(sv.getMounter(), volumeDevice, options, secrets); err != nil {
 		return "", err
 	}
 
-	return volumeDevice, secretWriter.Write(secrets, volumeDevice)
+	if options.Medium == ramfsMedium {
+		limit, err := ramfsSizeLimit(options)
+		if err != nil {
+			return "", err
+		}
+
+		if secretWriter, err = NewCappedSecretWriter(secretWriter, limit); err != nil {
+			return "", err
+		}
+	}
+
+	if err := secretWriter.Write(secrets, volumeDevice); err != nil {
+		return volumeDevice, err
+	}
+
+	// The record only feeds list, status and the audit hashes, it must not
+	// fail the attach. Secrets that cannot be hashed are kept without one.
+	record, err := newVolumeRecord(options, volumeDevice, secrets)
+	if err != nil {
+		log.Warnf("Failed to hash secrets of volume: %v", err)
+	}
+	event.withSecretRecords(record.Secrets)
+
+	if err := recordVolume(store, record); err != nil {
+		log.Warnf("Failed to record volume: %v", err)
+	}
+
+	return volumeDevice, nil
 }
 
 // Detach effectively erases the volume.
-func (sv *FlexVolume) Detach(device string) error {
-	if err := mount.Unmount(device); err != nil {
+func (sv *FlexVolume) Detach(device string) (err error) {
+	log := newCallLog("detach").withVolume(path.Base(device))
+	event := newAuditEvent(auditDetach)
+	event.Volume = path.Base(device)
+	event.Device = device
+	defer func() { sv.finish(log, event, err) }()
+
+	store := newStateStore(sv.config().stateDir)
+	if record, err := getVolumeRecord(store, device); err == nil {
+		event.withRecord(record)
+	}
+
+	if err := sv.getMounter().Unmount(device); err != nil {
 		return err
 	}
 
+	if err := forgetVolume(store, device); err != nil {
+		log.Warnf("Failed to forget volume: %v", err)
+	}
+
 	return os.RemoveAll(device)
 }
 
 // Mount implements does a bind mount of the volume to the target directory
-func (sv *FlexVolume) Mount(dir, device string, params map[string]interface{}) error {
+func (sv *FlexVolume) Mount(dir, device string, params map[string]interface{}) (err error) {
+	log := newCallLog("mount").withVolume(path.Base(device))
+	event := newAuditEvent(auditMount)
+	event.Volume = path.Base(device)
+	event.Device = device
+	defer func() { sv.finish(log, event, err) }()
+
+	options, err := decodeOptions(params)
+	if err != nil {
+		return err
+	}
+	log.withOptions(options)
+	event.withOptions(options)
+	event.withTarget(dir)
+
 	//Default volume mode
-	return mount.Mount(device, dir, "none", "bind,rw")
+	mountOpts := "bind,rw"
+	if options.ReadOnly || options.ReadWrite == "ro" {
+		mountOpts = "bind,ro"
+	}
 
+	return sv.getMounter().Mount(device, dir, "none", mountOpts)
 }
 
 // Unmount undoes the bind mount, and removes the target directory
-func (sv *FlexVolume) Unmount(dir string) error {
+func (sv *FlexVolume) Unmount(dir string) (err error) {
+	volume := volumeForTarget(sv.getMounter(), sv.config().stagingDir, dir)
+	log := newCallLog("unmount").withVolume(volume)
+	event := newAuditEvent(auditUnmount)
+	event.Volume = volume
+	event.withTarget(dir)
+	defer func() { sv.finish(log, event, err) }()
+
 	// This will be a bind mount
-	if err := mount.Unmount(dir); err != nil {
+	if err := sv.getMounter().Unmount(dir); err != nil {
 		return err
 	}
 	return os.RemoveAll(dir)
 }
 
-func createTmpfs(dir string, options map[string]interface{}) error {
-	mounted, err := mount.Mounted(dir)
+// finish logs, audits and records the metrics of a driver call
+func (sv *FlexVolume) finish(log *callLog, event *auditEvent, err error) {
+	log.done(err)
+	if event != nil {
+		event.emit(err)
+	}
+
+	if err := flushMetrics(newStateStore(sv.config().stateDir), metricsDir); err != nil {
+		log.Warnf("Failed to write metrics: %v", err)
+	}
+
+	logRedactor.reset()
+}
+
+func createTmpfs(mounter Mounter, dir string, options *options, secrets []secret) error {
+	mounted, err := mounter.Mounted(dir)
 	if mounted || err != nil {
 		return err
 	}
 
-	mode := int(0755)
-	mountOpts := "size=10m"
+	fsType := tmpfsMedium
+	mountOpts := ""
+	if options.Medium == ramfsMedium {
+		fsType = ramfsMedium
+		mountOpts, err = ramfsMountOptions(options)
+	} else {
+		mountOpts, err = tmpfsMountOptions(options, secrets)
+	}
+	if err != nil {
+		return err
+	}
 
-	if uMode, ok := options["mode"].(int); ok {
-		mode = int(uMode)
+	if err := os.MkdirAll(dir, options.Mode); err != nil {
+		return err
 	}
 
-	if mOpts, ok := options["mountOpts"].(string); ok {
-		mountOpts = mOpts
+	return mounter.Mount(fsType, dir, fsType, mountOpts)
+}
+
+// selectItems keeps only the named secrets, all of them if no items are
+// given.
+func selectItems(secrets []secret, items []string) ([]secret, error) {
+	if len(items) == 0 {
+		return secrets, nil
 	}
 
-	if err := os.MkdirAll(dir, os.FileMode(mode)); err != nil {
-		return err
+	byName := map[string]secret{}
+	for _, s := range secrets {
+		byName[s.Name] = s
+	}
+
+	selected := []secret{}
+	for _, item := range items {
+		s, ok := byName[item]
+		if !ok {
+			return nil, fmt.Errorf("Secret %s listed in items not found", item)
+		}
+		selected = append(selected, s)
 	}
 
-	return mount.Mount("tmpfs", dir, "tmpfs", mountOpts)
+	return selected, nil
 }
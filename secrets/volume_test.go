@@ -0,0 +1,264 @@
+package secrets
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// newTestVolume returns a FlexVolume on a fake mount table with every host
+// path below a temp dir, and a file backend secret app/db_password.
+func newTestVolume(t *testing.T) (*FlexVolume, *fakeMounter, string) {
+	tmpDir, err := ioutil.TempDir("", "volume")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, _ := age.GenerateX25519Identity()
+	cfg := hostConfig{
+		ageIdentityPath: path.Join(tmpDir, "host.age"),
+		fileSecretsRoot: path.Join(tmpDir, "secrets"),
+		fileAccessPath:  path.Join(tmpDir, "secrets-access.json"),
+		stateDir:        path.Join(tmpDir, "state"),
+		stagingDir:      path.Join(tmpDir, "staging"),
+	}
+	ioutil.WriteFile(cfg.ageIdentityPath, []byte(identity.String()+"\n"), 0600)
+	ioutil.WriteFile(cfg.fileAccessPath, []byte(`[{"namespace":"default","paths":["app"]}]`), 0600)
+
+	os.MkdirAll(path.Join(cfg.fileSecretsRoot, "app"), 0755)
+	writeAgeFile(t, path.Join(cfg.fileSecretsRoot, "app", "db_password.age"), false, "hunter2", identity.Recipient())
+
+	auditLogPath = path.Join(tmpDir, "audit.log")
+
+	mounter := newFakeMounter()
+	return &FlexVolume{mounter: mounter, cfg: &cfg}, mounter, tmpDir
+}
+
+func attachParams() map[string]interface{} {
+	return map[string]interface{}{"name": "vol", "backend": fileBackend, "secretsPath": "app", "kubernetes.io/pod.namespace": "default"}
+}
+
+func TestVolumeLifecycle(t *testing.T) {
+	defer func(orig string) { auditLogPath = orig }(auditLogPath)
+	sv, mounter, tmpDir := newTestVolume(t)
+	defer os.RemoveAll(tmpDir)
+
+	device, err := sv.Attach(attachParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device != path.Join(sv.cfg.stagingDir, "vol") {
+		t.Errorf("Unexpected device %s", device)
+	}
+	if m, ok := mounter.mounts[device]; !ok || m.fsType != tmpfsMedium || !strings.Contains(m.options, "noexec,nosuid,nodev") {
+		t.Errorf("Expected tmpfs on %s, got %+v", device, m)
+	}
+	if content, err := ioutil.ReadFile(path.Join(device, "db_password")); err != nil || string(content) != "hunter2" {
+		t.Errorf("Unexpected secret %q: %v", content, err)
+	}
+
+	// A second attach of a mounted volume does not mount again
+	calls := len(mounter.calls)
+	if _, err := sv.Attach(attachParams()); err != nil {
+		t.Fatal(err)
+	}
+	if len(mounter.calls) != calls {
+		t.Errorf("Unexpected mount calls: %v", mounter.calls[calls:])
+	}
+
+	target := path.Join(tmpDir, "pods", "abc", "volumes", "rancher~secrets", "vol")
+	if err := sv.Mount(target, device, map[string]interface{}{"readOnly": true}); err != nil {
+		t.Fatal(err)
+	}
+	if m := mounter.mounts[target]; m.device != device || m.options != "bind,ro" {
+		t.Errorf("Unexpected bind mount %+v", m)
+	}
+
+	if err := sv.Unmount(target); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mounter.mounts[target]; ok {
+		t.Error("Target still mounted")
+	}
+
+	if err := sv.Detach(device); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mounter.mounts[device]; ok {
+		t.Error("Device still mounted")
+	}
+	if _, err := os.Stat(device); !os.IsNotExist(err) {
+		t.Error("Device not removed")
+	}
+	if keys, _ := newStateStore(sv.cfg.stateDir).list(volumeStateKind); len(keys) != 0 {
+		t.Errorf("Volume still recorded: %v", keys)
+	}
+
+	audit, _ := ioutil.ReadFile(auditLogPath)
+	if n := strings.Count(string(audit), `"outcome":"success"`); n != 5 {
+		t.Errorf("Expected 5 successful audit events, got %d:\n%s", n, audit)
+	}
+	if !strings.Contains(string(audit), `"action":"unmount","outcome":"success","volume":"vol"`) {
+		t.Errorf("Unmount not attributed to the volume:\n%s", audit)
+	}
+}
+
+func TestVolumeCreateDelete(t *testing.T) {
+	defer func(orig string) { auditLogPath = orig }(auditLogPath)
+	sv, mounter, tmpDir := newTestVolume(t)
+	defer os.RemoveAll(tmpDir)
+
+	if _, err := sv.Create(map[string]interface{}{}); err == nil {
+		t.Error("Expected create without a name to fail")
+	}
+
+	resp, err := sv.Create(map[string]interface{}{"name": "vol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device, _ := resp["device"].(string)
+	if m, ok := mounter.mounts[device]; !ok || !strings.HasPrefix(m.options, "size=10m,") {
+		t.Errorf("Expected a 10m tmpfs on %s, got %+v", device, m)
+	}
+
+	if err := sv.Delete(map[string]interface{}{}); err != nil {
+		t.Error(err)
+	}
+	if err := sv.Delete(map[string]interface{}{"device": device}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mounter.mounts[device]; ok {
+		t.Error("Device still mounted after delete")
+	}
+}
+
+func TestVolumeFailures(t *testing.T) {
+	defer func(orig string) { auditLogPath = orig }(auditLogPath)
+	sv, mounter, tmpDir := newTestVolume(t)
+	defer os.RemoveAll(tmpDir)
+
+	mountErr := errors.New("mount failed")
+
+	mounter.fail["Mounted"] = mountErr
+	if _, err := sv.Attach(attachParams()); err != mountErr {
+		t.Errorf("Expected %v, got %v", mountErr, err)
+	}
+	delete(mounter.fail, "Mounted")
+
+	mounter.fail["Mount"] = mountErr
+	if _, err := sv.Attach(attachParams()); err != mountErr {
+		t.Errorf("Expected %v, got %v", mountErr, err)
+	}
+	if err := sv.Mount(path.Join(tmpDir, "target"), path.Join(sv.cfg.stagingDir, "vol"), map[string]interface{}{}); err != mountErr {
+		t.Errorf("Expected %v, got %v", mountErr, err)
+	}
+	delete(mounter.fail, "Mount")
+
+	params := attachParams()
+	params["secretsPath"] = "missing"
+	if _, err := sv.Attach(params); err == nil {
+		t.Error("Expected attach of missing secrets to fail")
+	}
+	if len(mounter.mounts) != 0 {
+		t.Error("Failed attach left a mount behind")
+	}
+
+	device, err := sv.Attach(attachParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mounter.fail["Unmount"] = mountErr
+	if err := sv.Detach(device); err != mountErr {
+		t.Errorf("Expected %v, got %v", mountErr, err)
+	}
+	if _, err := os.Stat(path.Join(device, "db_password")); err != nil {
+		t.Error("Failed detach removed the secrets")
+	}
+	if err := sv.Unmount(path.Join(tmpDir, "target")); err != mountErr {
+		t.Errorf("Expected %v, got %v", mountErr, err)
+	}
+	delete(mounter.fail, "Unmount")
+
+	if err := sv.Unmount(path.Join(tmpDir, "not-mounted")); err == nil {
+		t.Error("Expected unmount of a directory that is not mounted to fail")
+	}
+
+	audit, _ := ioutil.ReadFile(auditLogPath)
+	if n := strings.Count(string(audit), `"outcome":"failure"`); n != 7 {
+		t.Errorf("Expected 7 failed audit events, got %d:\n%s", n, audit)
+	}
+}
+
+func TestVolumeFileAccess(t *testing.T) {
+	defer func(orig string) { auditLogPath = orig }(auditLogPath)
+	sv, mounter, tmpDir := newTestVolume(t)
+	defer os.RemoveAll(tmpDir)
+
+	for _, ns := range []string{"other", ""} {
+		params := attachParams()
+		params["kubernetes.io/pod.namespace"] = ns
+		if _, err := sv.Attach(params); err == nil {
+			t.Errorf("Expected attach from namespace %q to be refused", ns)
+		}
+	}
+
+	params := attachParams()
+	params["rancher"] = "true"
+	if _, err := sv.Attach(params); err == nil {
+		t.Error("Expected attach by Rancher to be refused a pod's path")
+	}
+
+	params = attachParams()
+	params["backend"] = compositeBackend
+	params["backends"] = fileBackend
+	params["secretsPath"] = "../other"
+	if _, err := sv.Attach(params); err == nil {
+		t.Error("Expected composite attach of an ungranted path to be refused")
+	}
+
+	if len(mounter.calls) != 0 {
+		t.Errorf("Refused attach mounted: %v", mounter.calls)
+	}
+}
+
+func TestVolumeRecordFailure(t *testing.T) {
+	defer func(orig string) { auditLogPath = orig }(auditLogPath)
+	sv, _, tmpDir := newTestVolume(t)
+	defer os.RemoveAll(tmpDir)
+
+	// Nothing is written so the secrets cannot be hashed
+	sv.newGetter = func(*Options) (SecretGetter, error) { return tGet, nil }
+	sv.newDecryptor = func(*Options) (Decryptor, error) { return testDecryptor{}, nil }
+	sv.newWriter = func(Decryptor) (SecretWriter, error) {
+		return secretWriterFunc(func([]secret, string) error { return nil }), nil
+	}
+
+	device, err := sv.Attach(map[string]interface{}{"name": "vol", tokenOption: "onetime"})
+	if err != nil {
+		t.Fatalf("Expected attach to succeed without hashes, got %v", err)
+	}
+
+	record, err := getVolumeRecord(newStateStore(sv.config().stateDir), device)
+	if err != nil || record == nil {
+		t.Fatalf("Expected the volume to be recorded, got %v", err)
+	}
+	if len(record.Secrets) != len(tGet.Data) || record.Secrets[0].Name != "database_password" || record.Secrets[0].SHA256 != "" {
+		t.Errorf("Expected the secrets to be recorded without hashes, got %+v", record.Secrets)
+	}
+
+	audit, _ := ioutil.ReadFile(auditLogPath)
+	if !strings.Contains(string(audit), `"outcome":"success"`) || !strings.Contains(string(audit), `"name":"database_password"`) {
+		t.Errorf("Expected a successful audit event with the secret names:\n%s", audit)
+	}
+	if strings.Contains(string(audit), "sha256") {
+		t.Errorf("Expected no hashes in the audit event:\n%s", audit)
+	}
+}
@@ -0,0 +1,99 @@
+package secrets
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path"
+	"time"
+)
+
+const volumeStateKind = "volumes"
+
+// volumeRecord is what the driver remembers about an attached volume. It
+// never holds secret content, only a hash of it.
+type volumeRecord struct {
+	Name         string         `json:"name"`
+	Device       string         `json:"device"`
+	Backend      string         `json:"backend"`
+	Medium       string         `json:"medium"`
+	AttachedAt   time.Time      `json:"attachedAt"`
+	PodName      string         `json:"podName,omitempty"`
+	PodNamespace string         `json:"podNamespace,omitempty"`
+	PodUID       string         `json:"podUID,omitempty"`
+	Secrets      []secretRecord `json:"secrets"`
+}
+
+type secretRecord struct {
+	Name   string `json:"name"`
+	Mode   string `json:"mode"`
+	UID    string `json:"uid"`
+	GID    string `json:"gid"`
+	SHA256 string `json:"sha256"`
+}
+
+// newVolumeRecord describes the volume after a successful attach, hashing
+// the files as written. A file that cannot be hashed is recorded without its
+// SHA256 and the first error is returned along with the record.
+func newVolumeRecord(options *options, device string, secrets []secret) (*volumeRecord, error) {
+	backend := options.Backend
+	if backend == "" {
+		backend = rancherBackend
+	}
+
+	record := &volumeRecord{
+		Name:         options.Name,
+		Device:       device,
+		Backend:      backend,
+		Medium:       options.Medium,
+		AttachedAt:   time.Now().UTC(),
+		PodName:      options.PodName,
+		PodNamespace: options.PodNamespace,
+		PodUID:       options.PodUID,
+		Secrets:      []secretRecord{},
+	}
+
+	var hashErr error
+	for _, s := range secrets {
+		s.setDefaults()
+
+		sum, err := hashFile(path.Join(device, s.Name))
+		if err != nil && hashErr == nil {
+			hashErr = err
+		}
+
+		record.Secrets = append(record.Secrets, secretRecord{
+			Name:   s.Name,
+			Mode:   s.Mode,
+			UID:    s.UID,
+			GID:    s.GID,
+			SHA256: sum,
+		})
+	}
+
+	return record, hashErr
+}
+
+func recordVolume(store *stateStore, record *volumeRecord) error {
+	return store.put(volumeStateKind, record.Name, record)
+}
+
+func getVolumeRecord(store *stateStore, device string) (*volumeRecord, error) {
+	record := &volumeRecord{}
+	return record, store.get(volumeStateKind, path.Base(device), record)
+}
+
+func forgetVolume(store *stateStore, device string) error {
+	return store.remove(volumeStateKind, path.Base(device))
+}
+
+func hashFile(file string) (string, error) {
+	content, err := ioutil.ReadFile(file)
+	defer zero(content)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -1,9 +1,18 @@
 package secrets
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+
 	"github.com/rancher/secrets-api/pkg/aesutils"
 )
 
+// wiped is called with every buffer cleared by zero. Tests use it to check
+// that no secret material outlives a write.
+var wiped func(b []byte)
+
 // NewRSASecretFileWriter returns a SecretWriter implemenation to talk to Rancher
 func NewRSASecretFileWriter(decryptor Decryptor) (SecretWriter, error) {
 	return &rsaSecretFileWriter{
@@ -13,27 +22,70 @@ func NewRSASecretFileWriter(decryptor Decryptor) (SecretWriter, error) {
 
 func (rsw rsaSecretFileWriter) Write(secrets []secret, dstDir string) error {
 	for _, secret := range secrets {
-		encData, err := getEncryptedData(secret.RewrapText)
-		if err != nil {
+		if err := rsw.writeSecret(secret, dstDir); err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		aesKey, err := rsw.decryptor.Decrypt(encData.EncryptedKey.EncryptedText)
-		if err != nil {
-			return err
-		}
+// writeSecret keeps the AES key and the cleartext in byte slices so they
+// can be wiped as soon as the file is written.
+func (rsw rsaSecretFileWriter) writeSecret(secret secret, dstDir string) error {
+	encData, err := getEncryptedData(secret.RewrapText)
+	if err != nil {
+		return err
+	}
 
-		aesDecryptionKey := aesutils.NewAESKeyFromBytes(aesKey)
+	aesKey, err := rsw.decryptor.Decrypt(encData.EncryptedKey.EncryptedText)
+	defer zero(aesKey)
+	if err != nil {
+		return err
+	}
 
-		clearText, err := aesutils.GetClearText(aesDecryptionKey, encData.EncryptedText)
-		if err != nil {
-			return err
-		}
+	span := startSpan("GetClearText")
+	clearText, err := getClearText(aesKey, encData.EncryptedText)
+	span.finish(err)
+	defer zero(clearText)
+	if err != nil {
+		countDecryptFailure(rancherBackend)
+		return err
+	}
 
-		err = secret.writeFile(dstDir, []byte(clearText))
-		if err != nil {
-			return err
-		}
+	return secret.writeBase64File(dstDir, clearText)
+}
+
+// getClearText is aesutils.GetClearText returning a byte slice instead of an
+// immutable string.
+func getClearText(key []byte, secretBlob string) ([]byte, error) {
+	secret := &aesutils.AESSecret{}
+	if err := json.Unmarshal([]byte(secretBlob), secret); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(secret.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("Invalid nonce size")
+	}
+
+	return gcm.Open(nil, secret.Nonce, secret.CipherText, nil)
+}
+
+// zero overwrites key material and cleartext once it is no longer needed
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	if wiped != nil {
+		wiped(b)
 	}
-	return nil
 }
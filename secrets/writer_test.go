@@ -58,7 +58,11 @@ func (tg testGetter) GetSecrets(params *options) ([]secret, error) {
 }
 
 func TestWriter(t *testing.T) {
-	dstDir := "/tmp/testdata"
+	dstDir, err := ioutil.TempDir("", "testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
 
 	sw, err := NewRSASecretFileWriter(testDecryptor{})
 	if err != nil {
@@ -66,11 +70,6 @@ func TestWriter(t *testing.T) {
 		return
 	}
 
-	// Setups the temp directory
-	if err = os.MkdirAll(dstDir, 0755); err != nil {
-		t.Error(err)
-	}
-
 	secrets, _ := tGet.GetSecrets(paramFixture)
 
 	// Calls write method
@@ -114,3 +113,45 @@ func TestWriter(t *testing.T) {
 	}
 	return
 }
+
+func TestWriterWipesBuffers(t *testing.T) {
+	dstDir, err := ioutil.TempDir("", "wipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	buffers := [][]byte{}
+	wiped = func(b []byte) {
+		buffers = append(buffers, b)
+	}
+	defer func() { wiped = nil }()
+
+	sw, _ := NewRSASecretFileWriter(testDecryptor{})
+	if err := sw.Write(tGet.Data, dstDir); err != nil {
+		t.Fatal(err)
+	}
+
+	ctw, _ := NewClearTextSecretWriter()
+	clearText := []byte("hello")
+	if err := ctw.Write([]secret{{Name: "clear", clearText: clearText}}, dstDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// AES key, base64 cleartext and decoded cleartext for each secret
+	if expected := 3*len(tGet.Data) + 1; len(buffers) != expected {
+		t.Errorf("Expected %d wiped buffers, got %d", expected, len(buffers))
+	}
+
+	for _, b := range buffers {
+		for _, c := range b {
+			if c != 0 {
+				t.Fatalf("Buffer not wiped: %v", b)
+			}
+		}
+	}
+
+	if string(clearText) == "hello" {
+		t.Error("Expected cleartext of getter to be wiped")
+	}
+}